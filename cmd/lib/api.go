@@ -0,0 +1,144 @@
+package main
+
+/*
+#include <stdlib.h>
+
+// TONUTILS_PROXY_API_VERSION - version of api, increased on incompatible changes
+#define TONUTILS_PROXY_API_VERSION 2
+
+// Codes returned in "Code" field of json results
+enum TonutilsProxyCode {
+	TONUTILS_PROXY_OK = 0,
+	TONUTILS_PROXY_ERR_ALREADY_STARTED = 1,
+	TONUTILS_PROXY_ERR_NOT_STARTED = 2,
+	TONUTILS_PROXY_ERR_INVALID_ARGUMENT = 3,
+	TONUTILS_PROXY_ERR_START_FAILED = 4,
+	TONUTILS_PROXY_ERR_INTERNAL = 5,
+	TONUTILS_PROXY_ERR_REQUEST_FAILED = 6,
+	TONUTILS_PROXY_ERR_ABORTED = 7
+};
+*/
+import "C"
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/xssnick/tonutils-proxy/proxy"
+	"unsafe"
+)
+
+const (
+	codeOK              = int(C.TONUTILS_PROXY_OK)
+	codeAlreadyStarted  = int(C.TONUTILS_PROXY_ERR_ALREADY_STARTED)
+	codeNotStarted      = int(C.TONUTILS_PROXY_ERR_NOT_STARTED)
+	codeInvalidArgument = int(C.TONUTILS_PROXY_ERR_INVALID_ARGUMENT)
+	codeStartFailed     = int(C.TONUTILS_PROXY_ERR_START_FAILED)
+	codeInternal        = int(C.TONUTILS_PROXY_ERR_INTERNAL)
+	codeRequestFailed   = int(C.TONUTILS_PROXY_ERR_REQUEST_FAILED)
+	codeAborted         = int(C.TONUTILS_PROXY_ERR_ABORTED)
+)
+
+// apiResult - json returned by api functions, Result is set only on success
+type apiResult struct {
+	Code   int
+	Error  string `json:",omitempty"`
+	Result any    `json:",omitempty"`
+}
+
+type apiStatus struct {
+	Running bool
+	State   proxy.State
+	// Proxy - detailed status, when proxy is running
+	Proxy *proxy.Status `json:",omitempty"`
+}
+
+type apiVersion struct {
+	API   int
+	Build string
+}
+
+func result(code int, err error, res any) *C.char {
+	r := apiResult{Code: code, Result: res}
+	if err != nil {
+		r.Error = err.Error()
+	}
+
+	data, err := json.Marshal(r)
+	if err != nil {
+		data, _ = json.Marshal(apiResult{Code: codeInternal, Error: "failed to serialize result: " + err.Error()})
+	}
+	return C.CString(string(data))
+}
+
+// FreeProxyString - frees string returned by any function of this library
+//
+//export FreeProxyString
+func FreeProxyString(str *C.char) {
+	C.free(unsafe.Pointer(str))
+}
+
+// GetProxyVersion - returns json result with api version and build
+//
+//export GetProxyVersion
+func GetProxyVersion() *C.char {
+	return result(codeOK, nil, apiVersion{API: int(C.TONUTILS_PROXY_API_VERSION), Build: GitCommit})
+}
+
+// StartProxyWithOptions - starts proxy with options json and waits until it is ready, returns json result.
+// Options: {"ListenAddr": "127.0.0.1:8080", "NetworkConfig": {...}, "NetworkConfigURL": "", "ADNLKey": "<base64 32 bytes seed>",
+// "TunnelConfig": {...}, "TunnelNetworkConfig": {...}, "BlockHttp": false, "NoListener": false}, all fields are optional.
+//
+//export StartProxyWithOptions
+func StartProxyWithOptions(optionsJSON *C.char) *C.char {
+	var opts startOptions
+	if optionsJSON != nil {
+		if err := json.Unmarshal([]byte(C.GoString(optionsJSON)), &opts); err != nil {
+			return result(codeInvalidArgument, fmt.Errorf("failed to parse options: %w", err), nil)
+		}
+	}
+
+	if opts.ListenAddr == "" && opts.Port == 0 {
+		opts.ListenAddr = "127.0.0.1:8080"
+	}
+
+	code, err := start(opts)
+	return result(code, err, nil)
+}
+
+// ShutdownProxy - stops running proxy, returns json result
+//
+//export ShutdownProxy
+func ShutdownProxy() *C.char {
+	p := getInstance()
+	if p == nil {
+		return result(codeNotStarted, errors.New("proxy is not started"), nil)
+	}
+
+	p.Stop()
+	return result(codeOK, nil, nil)
+}
+
+// GetProxyStatus - returns json result with state of proxy, and its sites, bags and tunnel when it is running
+//
+//export GetProxyStatus
+func GetProxyStatus() *C.char {
+	st := apiStatus{State: getState()}
+	if p := getInstance(); p != nil {
+		if s, ok := p.Status(); ok {
+			st.Running = true
+			st.Proxy = &s
+		}
+	}
+	return result(codeOK, nil, st)
+}
+
+// SetProxyLogLevel - changes log level, one of: trace, debug, info, warn, error, disabled; returns json result
+//
+//export SetProxyLogLevel
+func SetProxyLogLevel(level *C.char) *C.char {
+	lvl, err := proxy.SetLogLevel(C.GoString(level))
+	if err != nil {
+		return result(codeInvalidArgument, err, nil)
+	}
+	return result(codeOK, nil, lvl.String())
+}
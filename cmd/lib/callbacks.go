@@ -0,0 +1,210 @@
+package main
+
+/*
+#include <stdlib.h>
+
+// TonutilsProxyEventCallback - receives events with json payload, json is freed after callback returns,
+// callback is called from library threads and should not block for long
+typedef void (*TonutilsProxyEventCallback)(void* userData, int eventType, char* eventJSON);
+
+// Event types passed to callback
+enum TonutilsProxyEvent {
+	// {"Type": "loading|ready|error|stopped", "State": "...", "Stopped": false}
+	TONUTILS_PROXY_EVENT_STATE = 1,
+	// {"Addr": "1.2.3.4:1234"} - external address of tunnel changed
+	TONUTILS_PROXY_EVENT_TUNNEL = 2,
+	// {"Paid": "0.05"} - total amount paid for tunnel in TON
+	TONUTILS_PROXY_EVENT_PAID = 3,
+	// {"Error": "..."}
+	TONUTILS_PROXY_EVENT_ERROR = 4,
+	// {} - tunnel was stopped
+	TONUTILS_PROXY_EVENT_TUNNEL_STOPPED = 5,
+	// {"ID": 1, "Sections": [{"Name": "...", "Outer": false}], "PriceIn": "0.01", "PriceOut": "0.01"} -
+	// route should be answered with AnswerProxyPrompt and one of TonutilsProxyTunnelDecision
+	TONUTILS_PROXY_EVENT_TUNNEL_ACCEPT_REQUEST = 6,
+	// {"ID": 1} - tunnel is broken, answer with AnswerProxyPrompt, 1 to build new route, 0 to wait
+	TONUTILS_PROXY_EVENT_TUNNEL_REROUTE_REQUEST = 7
+};
+
+// Answers to tunnel accept request
+enum TonutilsProxyTunnelDecision {
+	// start without tunnel
+	TONUTILS_PROXY_TUNNEL_CANCEL = 0,
+	TONUTILS_PROXY_TUNNEL_ACCEPT = 1,
+	// try another route
+	TONUTILS_PROXY_TUNNEL_REJECT = 2
+};
+
+static inline void callEventCallback(TonutilsProxyEventCallback cb, void* userData, int eventType, char* eventJSON) {
+	cb(userData, eventType, eventJSON);
+}
+*/
+import "C"
+import (
+	"encoding/json"
+	"errors"
+	"github.com/rs/zerolog/log"
+	"github.com/ton-blockchain/adnl-tunnel/tunnel"
+	"github.com/xssnick/tonutils-go/tlb"
+	"github.com/xssnick/tonutils-proxy/proxy"
+	"sync"
+	"unsafe"
+)
+
+const (
+	eventState                = int(C.TONUTILS_PROXY_EVENT_STATE)
+	eventTunnel               = int(C.TONUTILS_PROXY_EVENT_TUNNEL)
+	eventPaid                 = int(C.TONUTILS_PROXY_EVENT_PAID)
+	eventError                = int(C.TONUTILS_PROXY_EVENT_ERROR)
+	eventTunnelStopped        = int(C.TONUTILS_PROXY_EVENT_TUNNEL_STOPPED)
+	eventTunnelAcceptRequest  = int(C.TONUTILS_PROXY_EVENT_TUNNEL_ACCEPT_REQUEST)
+	eventTunnelRerouteRequest = int(C.TONUTILS_PROXY_EVENT_TUNNEL_REROUTE_REQUEST)
+)
+
+type eventCallback struct {
+	fn       C.TonutilsProxyEventCallback
+	userData unsafe.Pointer
+}
+
+var callback *eventCallback
+var callbackMx sync.RWMutex
+
+// prompts - questions waiting for answer from app, by id
+var prompts = map[int64]chan int{}
+var lastPromptID int64
+var promptsMx sync.Mutex
+
+type tunnelEvent struct {
+	Addr string
+}
+
+type paidEvent struct {
+	Paid string
+}
+
+type errorEvent struct {
+	Error string
+}
+
+type acceptRequest struct {
+	ID int64
+	proxy.RouteInfo
+}
+
+type rerouteRequest struct {
+	ID int64
+}
+
+// setHooks - forwards proxy events to registered callback
+func setHooks(cfg *proxy.Options) {
+	cfg.OnTunnel = func(addr string) {
+		emit(eventTunnel, tunnelEvent{Addr: addr})
+	}
+	cfg.OnPaidUpdate = func(paid tlb.Coins) {
+		emit(eventPaid, paidEvent{Paid: paid.String()})
+	}
+	cfg.OnTunnelStopped = func() {
+		emit(eventTunnelStopped, struct{}{})
+	}
+	cfg.OnAskAccept = func(to, from []*tunnel.SectionInfo) int {
+		route, err := proxy.DescribeRoute(to, from)
+		if err != nil {
+			emit(eventError, errorEvent{Error: err.Error()})
+			return tunnel.AcceptorDecisionCancel
+		}
+
+		return ask(tunnel.AcceptorDecisionAccept, func(id int64) (int, any) {
+			return eventTunnelAcceptRequest, acceptRequest{ID: id, RouteInfo: route}
+		})
+	}
+	cfg.OnAskReroute = func() bool {
+		return ask(0, func(id int64) (int, any) {
+			return eventTunnelRerouteRequest, rerouteRequest{ID: id}
+		}) == 1
+	}
+}
+
+// SetProxyEventCallback - registers callback to receive events, userData is passed to it as is,
+// NULL callback unregisters it, returns json result
+//
+//export SetProxyEventCallback
+func SetProxyEventCallback(cb C.TonutilsProxyEventCallback, userData unsafe.Pointer) *C.char {
+	callbackMx.Lock()
+	if cb == nil {
+		callback = nil
+	} else {
+		callback = &eventCallback{fn: cb, userData: userData}
+	}
+	callbackMx.Unlock()
+
+	return result(codeOK, nil, nil)
+}
+
+// AnswerProxyPrompt - answers tunnel accept or reroute request by its id, returns json result
+//
+//export AnswerProxyPrompt
+func AnswerProxyPrompt(id C.longlong, answer C.int) *C.char {
+	promptsMx.Lock()
+	ch, ok := prompts[int64(id)]
+	delete(prompts, int64(id))
+	promptsMx.Unlock()
+
+	if !ok {
+		return result(codeInvalidArgument, errors.New("prompt is not found or already answered"), nil)
+	}
+
+	ch <- int(answer)
+	return result(codeOK, nil, nil)
+}
+
+// emit - passes event to registered callback, returns false when there is no callback
+func emit(eventType int, payload any) bool {
+	callbackMx.RLock()
+	cb := callback
+	callbackMx.RUnlock()
+
+	if cb == nil {
+		return false
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		log.Error().Err(err).Int("type", eventType).Msg("failed to serialize event")
+		return true
+	}
+
+	cData := C.CString(string(data))
+	defer C.free(unsafe.Pointer(cData))
+
+	C.callEventCallback(cb.fn, cb.userData, C.int(eventType), cData)
+	return true
+}
+
+// ask - sends request event and waits for answer, def is returned when nobody listens for events,
+// cancel is returned when proxy is stopped before answer
+func ask(def int, request func(id int64) (int, any)) int {
+	ch := make(chan int, 1)
+
+	promptsMx.Lock()
+	lastPromptID++
+	id := lastPromptID
+	prompts[id] = ch
+	promptsMx.Unlock()
+
+	defer func() {
+		promptsMx.Lock()
+		delete(prompts, id)
+		promptsMx.Unlock()
+	}()
+
+	if !emit(request(id)) {
+		return def
+	}
+
+	select {
+	case <-getStopped():
+		return tunnel.AcceptorDecisionCancel
+	case v := <-ch:
+		return v
+	}
+}
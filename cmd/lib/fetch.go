@@ -0,0 +1,156 @@
+package main
+
+/*
+#include <stdlib.h>
+
+// TonutilsProxyHeadCallback - receives response head json before body: {"Status": 200, "Headers": {"Name": ["value"]}},
+// json is freed after callback returns, non zero return aborts request
+typedef int (*TonutilsProxyHeadCallback)(void* userData, char* headJSON);
+
+// TonutilsProxyBodyCallback - receives next chunk of response body, data is freed after callback returns,
+// non zero return aborts request
+typedef int (*TonutilsProxyBodyCallback)(void* userData, void* data, int size);
+
+static inline int callHeadCallback(TonutilsProxyHeadCallback cb, void* userData, char* headJSON) {
+	return cb(userData, headJSON);
+}
+
+static inline int callBodyCallback(TonutilsProxyBodyCallback cb, void* userData, void* data, int size) {
+	return cb(userData, data, size);
+}
+*/
+import "C"
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/xssnick/tonutils-proxy/proxy"
+	"io"
+	"net/http"
+	"time"
+	"unsafe"
+)
+
+const _FetchChunkSize = 64 << 10
+
+// fetchRequest - json request of FetchURL
+type fetchRequest struct {
+	Method  string
+	URL     string
+	Headers http.Header
+	// Body - base64 in json
+	Body       []byte
+	TimeoutSec int
+}
+
+type fetchHead struct {
+	Status  int
+	Headers http.Header
+}
+
+type fetchResponse struct {
+	fetchHead
+	BodySize int64
+	// Body - base64 in json, set only when body callback is not passed
+	Body []byte `json:",omitempty"`
+}
+
+// FetchURL - makes http request through running proxy without any listening socket, so app don't need to
+// configure webview proxy. Request: {"Method": "GET", "URL": "http://foundation.ton/", "Headers": {"Name": ["value"]},
+// "Body": "<base64>", "TimeoutSec": 60}, only URL is required. When onBody is not NULL, body is streamed
+// to callbacks, otherwise it is returned in result base64 encoded. Blocks until request is completed, returns json result.
+//
+//export FetchURL
+func FetchURL(requestJSON *C.char, onHead C.TonutilsProxyHeadCallback, onBody C.TonutilsProxyBodyCallback, userData unsafe.Pointer) *C.char {
+	var r fetchRequest
+	if requestJSON == nil {
+		return result(codeInvalidArgument, errors.New("request is not passed"), nil)
+	}
+	if err := json.Unmarshal([]byte(C.GoString(requestJSON)), &r); err != nil {
+		return result(codeInvalidArgument, fmt.Errorf("failed to parse request: %w", err), nil)
+	}
+
+	if r.Method == "" {
+		r.Method = http.MethodGet
+	}
+
+	ctx := context.Background()
+	if r.TimeoutSec > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(r.TimeoutSec)*time.Second)
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, r.Method, r.URL, bytes.NewReader(r.Body))
+	if err != nil {
+		return result(codeInvalidArgument, fmt.Errorf("invalid request: %w", err), nil)
+	}
+	if len(r.Body) == 0 {
+		req.Body = http.NoBody
+	}
+	for k, v := range r.Headers {
+		req.Header[http.CanonicalHeaderKey(k)] = v
+	}
+
+	p := getInstance()
+	if p == nil {
+		return result(codeNotStarted, proxy.ErrNotRunning, nil)
+	}
+
+	resp, err := p.Do(req)
+	if err != nil {
+		if errors.Is(err, proxy.ErrNotRunning) {
+			return result(codeNotStarted, err, nil)
+		}
+		return result(codeRequestFailed, err, nil)
+	}
+	defer resp.Body.Close()
+
+	res := fetchResponse{fetchHead: fetchHead{Status: resp.StatusCode, Headers: resp.Header}}
+
+	if onHead != nil {
+		data, err := json.Marshal(res.fetchHead)
+		if err != nil {
+			return result(codeInternal, fmt.Errorf("failed to serialize head: %w", err), nil)
+		}
+
+		cData := C.CString(string(data))
+		aborted := C.callHeadCallback(onHead, userData, cData) != 0
+		C.free(unsafe.Pointer(cData))
+		if aborted {
+			return result(codeAborted, errors.New("aborted by head callback"), nil)
+		}
+	}
+
+	if onBody == nil {
+		res.Body, err = io.ReadAll(resp.Body)
+		res.BodySize = int64(len(res.Body))
+		if err != nil {
+			return result(codeRequestFailed, fmt.Errorf("failed to read body: %w", err), nil)
+		}
+		return result(codeOK, nil, res)
+	}
+
+	buf := C.malloc(_FetchChunkSize)
+	defer C.free(buf)
+
+	chunk := unsafe.Slice((*byte)(buf), _FetchChunkSize)
+	for {
+		n, err := resp.Body.Read(chunk)
+		if n > 0 {
+			res.BodySize += int64(n)
+			if C.callBodyCallback(onBody, userData, buf, C.int(n)) != 0 {
+				return result(codeAborted, errors.New("aborted by body callback"), nil)
+			}
+		}
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return result(codeRequestFailed, fmt.Errorf("failed to read body: %w", err), nil)
+		}
+	}
+	return result(codeOK, nil, res)
+}
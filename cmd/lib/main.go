@@ -2,93 +2,184 @@ package main
 
 import "C"
 import (
-	"context"
+	"crypto/ed25519"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/rs/zerolog/log"
+	tunnelConfig "github.com/ton-blockchain/adnl-tunnel/config"
 	"github.com/xssnick/tonutils-go/liteclient"
 	"github.com/xssnick/tonutils-proxy/proxy"
-	"log"
+	"sync"
 )
 
 var GitCommit string
 
 func main() {}
 
-var ActiveProxy context.Context
-var ProxyStopper context.CancelFunc
+// instance - last started proxy, running is true from start until it is completely stopped
+var instance *proxy.Proxy
+var running bool
+
+// stopped - closed when proxy is stopped, to cancel prompts waiting for answer
+var stopped = make(chan struct{})
+var instanceMx sync.Mutex
+
+// lastState - last state reported by running or stopped proxy
+var lastState = proxy.State{Type: "stopped", State: "not started", Stopped: true}
+var stateMx sync.Mutex
 
 func init() {
-	ActiveProxy, ProxyStopper = context.WithCancel(context.Background())
-	ProxyStopper() // mark it not started
+	close(stopped)
 }
 
+// StartProxy - legacy api, returned string should be freed with FreeProxyString
+//
 //export StartProxy
 func StartProxy(port C.ushort) *C.char {
-	return C.CString(startProxy(uint16(port), nil))
+	return C.CString(legacyResult(start(startOptions{Port: uint16(port)})))
 }
 
+// StartProxyWithConfig - legacy api, returned string should be freed with FreeProxyString
+//
 //export StartProxyWithConfig
 func StartProxyWithConfig(port C.ushort, configTextJSON *C.char) *C.char {
 	var cfg liteclient.GlobalConfig
 	if err := json.Unmarshal([]byte(C.GoString(configTextJSON)), &cfg); err != nil {
-		log.Println("failed to parse config:", err.Error())
+		log.Error().Err(err).Msg("failed to parse config")
 		return C.CString("PARSE_CONFIG_ERR: " + err.Error())
 	}
 
-	return C.CString(startProxy(uint16(port), &cfg))
+	return C.CString(legacyResult(start(startOptions{Port: uint16(port), NetworkConfig: &cfg})))
 }
 
+// StopProxy - legacy api, returned string should be freed with FreeProxyString
+//
 //export StopProxy
 func StopProxy() *C.char {
-	ProxyStopper()
+	if p := getInstance(); p != nil {
+		p.Stop()
+	}
 	return C.CString("OK")
 }
 
-func startProxy(port uint16, cfg *liteclient.GlobalConfig) string {
-	select {
-	case <-ActiveProxy.Done():
-	default:
+func legacyResult(code int, err error) string {
+	switch code {
+	case codeOK:
+		return "OK"
+	case codeAlreadyStarted:
 		return "ALREADY_STARTED"
 	}
+	return "ERR: " + err.Error()
+}
 
-	ActiveProxy, ProxyStopper = context.WithCancel(context.Background())
+type startOptions struct {
+	// ListenAddr - address to listen on, 127.0.0.1:Port is used when empty
+	ListenAddr string
+	Port       uint16
+	// NoListener - do not listen on any address, requests are made only with FetchURL
+	NoListener bool
+	// NetworkConfig - ton network config, downloaded when empty
+	NetworkConfig *liteclient.GlobalConfig
+	// NetworkConfigURL - config is refreshed from it periodically, passed config is refreshed only when it is set
+	NetworkConfigURL string
+	// ADNLKey - 32 bytes seed of ed25519 key, base64 in json, random key is used when empty
+	ADNLKey []byte
+	// TunnelConfig - adnl tunnel client config, tunnel is not used when empty
+	TunnelConfig *tunnelConfig.ClientConfig
+	// TunnelNetworkConfig - custom network config for tunnel payments
+	TunnelNetworkConfig *liteclient.GlobalConfig
+	BlockHttp           bool
+}
 
-	var ch = make(chan proxy.State, 1)
-	var err error
-	go func() {
-		if cfg != nil {
-			err = proxy.RunProxyWithConfig(ActiveProxy, "127.0.0.1:"+fmt.Sprint(port), nil, nil, false, "LIB "+GitCommit, cfg, nil, nil)
-		} else {
-			err = proxy.RunProxy(ActiveProxy, "127.0.0.1:"+fmt.Sprint(port), nil, ch, "LIB "+GitCommit, false, "", nil, nil)
-		}
-		if err != nil {
-			log.Println("failed to start proxy:", err.Error())
-			ch <- proxy.State{Type: "error", State: err.Error(), Stopped: true}
-		}
-	}()
-
-	var res = make(chan string, 1)
-	go func() {
-		for {
-			select {
-			case <-ActiveProxy.Done():
-				return
-			case state := <-ch:
-				var msg string
-				if state.Stopped {
-					ProxyStopper()
-					msg = "ERR: " + state.State
-				} else if state.Type == "ready" {
-					msg = "OK"
-				}
-
-				select {
-				case res <- msg:
-				default:
-				}
-			}
+func setState(st proxy.State) {
+	stateMx.Lock()
+	lastState = st
+	stateMx.Unlock()
+
+	emit(eventState, st)
+	if st.Type == "error" {
+		emit(eventError, errorEvent{Error: st.State})
+	}
+}
+
+func getState() proxy.State {
+	stateMx.Lock()
+	defer stateMx.Unlock()
+	return lastState
+}
+
+// getInstance - returns running proxy, nil when it is not running
+func getInstance() *proxy.Proxy {
+	instanceMx.Lock()
+	defer instanceMx.Unlock()
+	if !running {
+		return nil
+	}
+	return instance
+}
+
+// getStopped - returns channel which is closed when current proxy is stopped
+func getStopped() <-chan struct{} {
+	instanceMx.Lock()
+	defer instanceMx.Unlock()
+	return stopped
+}
+
+// start - starts proxy and waits until it is ready or failed
+func start(opts startOptions) (int, error) {
+	cfg := proxy.Options{
+		ListenAddr:          opts.ListenAddr,
+		Version:             "LIB " + GitCommit,
+		BlockHttp:           opts.BlockHttp,
+		NetworkConfig:       opts.NetworkConfig,
+		NetworkConfigURL:    opts.NetworkConfigURL,
+		Tunnel:              opts.TunnelConfig,
+		TunnelNetworkConfig: opts.TunnelNetworkConfig,
+		OnState:             setState,
+	}
+	setHooks(&cfg)
+
+	if opts.NoListener {
+		cfg.ListenAddr = ""
+	} else if cfg.ListenAddr == "" {
+		cfg.ListenAddr = "127.0.0.1:" + fmt.Sprint(opts.Port)
+	}
+
+	if opts.ADNLKey != nil {
+		if len(opts.ADNLKey) != ed25519.SeedSize {
+			return codeInvalidArgument, fmt.Errorf("adnl key should be %d bytes seed", ed25519.SeedSize)
 		}
-	}()
+		cfg.ADNLKey = ed25519.NewKeyFromSeed(opts.ADNLKey)
+	}
+
+	p := proxy.New(cfg)
+
+	instanceMx.Lock()
+	if running {
+		instanceMx.Unlock()
+		return codeAlreadyStarted, errors.New("proxy is already started")
+	}
+	running, instance = true, p
+	stop := make(chan struct{})
+	stopped = stop
+	instanceMx.Unlock()
+
+	release := func() {
+		_ = p.Wait()
+
+		instanceMx.Lock()
+		running = false
+		instanceMx.Unlock()
+		close(stop)
+	}
+
+	if err := p.Start(); err != nil {
+		log.Error().Err(err).Msg("failed to start proxy")
+		release()
+		return codeStartFailed, err
+	}
 
-	return <-res
+	go release()
+	return codeOK, nil
 }
@@ -4,6 +4,9 @@ import (
 	"crypto/ed25519"
 	"encoding/json"
 	tunnelConfig "github.com/ton-blockchain/adnl-tunnel/config"
+	"github.com/xssnick/tonutils-proxy/proxy"
+	"github.com/xssnick/tonutils-proxy/proxy/accesslog"
+	"github.com/xssnick/tonutils-proxy/proxy/tracing"
 	"os"
 	"sync"
 )
@@ -15,6 +18,35 @@ type Config struct {
 	CustomTunnelNetworkConfigPath string
 	TunnelConfig                  *tunnelConfig.ClientConfig
 
+	// AdminAPIToken - enables admin api at http://proxy.local/api/ when set
+	AdminAPIToken string
+
+	// AccessLog - enables access log of proxied requests when set
+	AccessLog *accesslog.Config
+
+	// Tracing - enables opentelemetry tracing of requests when set
+	Tracing *tracing.Config
+
+	// Auth - users and allowed ips of proxy listener, required to listen on non-loopback address
+	Auth *proxy.AuthConfig
+
+	// Gateway - enables limits per client, when proxy is shared by many machines
+	Gateway *proxy.GatewayConfig
+
+	// PACDomains - additional domains to route through proxy in pac file
+	PACDomains []string
+
+	// RoutingRulesPath - json file with routing rules, default rules are used when empty
+	RoutingRulesPath string
+
+	// Upstream - proxy to send ordinary internet requests through
+	Upstream *proxy.UpstreamConfig
+
+	// TunnelWeb2 - send web2 requests through tunnel over HTTP/3 too
+	TunnelWeb2 bool
+	// TunnelWeb2DoH - DNS over HTTPS server to resolve web2 domains through tunnel, default is used when empty
+	TunnelWeb2DoH string
+
 	mx sync.Mutex
 }
 
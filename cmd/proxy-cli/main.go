@@ -1,15 +1,24 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"errors"
 	"flag"
+	"fmt"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"github.com/xssnick/tonutils-go/liteclient"
 	"github.com/xssnick/tonutils-proxy/cmd/proxy-cli/config"
 	"github.com/xssnick/tonutils-proxy/proxy"
+	"github.com/xssnick/tonutils-proxy/proxy/accesslog"
+	"github.com/xssnick/tonutils-proxy/proxy/tracing"
+	"golang.org/x/term"
+	"io"
 	"os"
 	"os/signal"
+	"strings"
+	"time"
 )
 
 var GitCommit = "dev"
@@ -19,12 +28,33 @@ func main() {
 	var verbosity = flag.Int("verbosity", 2, "Debug logs")
 	var blockHttp = flag.Bool("no-http", false, "Block ordinary http requests")
 	var networkConfigPath = flag.String("global-config", "", "path to ton network config file")
+	var metricsAddr = flag.String("metrics-addr", "", "The addr to serve prometheus metrics on, disabled if empty.")
+	var hashPassword = flag.Bool("hash-password", false, "Read password from stdin, print its hash to use in Auth config and exit.")
+	var shutdownTimeout = flag.Duration("shutdown-timeout", proxy.DefaultShutdownTimeout, "Max time to wait for active downloads on shutdown.")
 
 	flag.Parse()
 
-	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stdout}).Level(zerolog.InfoLevel)
+	if *hashPassword {
+		password, err := readPassword()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "failed to read password:", err.Error())
+			os.Exit(1)
+		}
+
+		hash, err := proxy.HashPassword(password)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "failed to hash password:", err.Error())
+			os.Exit(1)
+		}
+		fmt.Println(hash)
+		return
+	}
+
+	// level is set globally, so it could be changed later using admin api
+	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stdout})
+	zerolog.SetGlobalLevel(zerolog.InfoLevel)
 	if *verbosity >= 3 {
-		log.Logger = log.Logger.Level(zerolog.DebugLevel)
+		zerolog.SetGlobalLevel(zerolog.DebugLevel)
 	}
 
 	log.Info().Msg("Version:" + GitCommit)
@@ -38,6 +68,38 @@ func main() {
 		return
 	}
 
+	var rules []proxy.RoutingRule
+	if cfg.RoutingRulesPath != "" {
+		rules, err = proxy.LoadRoutingRules(cfg.RoutingRulesPath)
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to load routing rules")
+			return
+		}
+	}
+
+	var accessLog *accesslog.Logger
+	if cfg.AccessLog != nil {
+		accessLog, err = accesslog.New(*cfg.AccessLog)
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to init access log")
+			return
+		}
+		defer accessLog.Close()
+	}
+
+	if cfg.Tracing != nil {
+		shutdownTracing, err := tracing.Setup(context.Background(), *cfg.Tracing, GitCommit)
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to init tracing")
+			return
+		}
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			_ = shutdownTracing(ctx)
+		}()
+	}
+
 	var customTinNetCfg *liteclient.GlobalConfig
 	if cfg.CustomTunnelNetworkConfigPath != "" {
 		customTinNetCfg, err = liteclient.GetConfigFromFile(cfg.CustomTunnelNetworkConfigPath)
@@ -46,19 +108,47 @@ func main() {
 		}
 	}
 
+	opts := proxy.Options{
+		ListenAddr:          *addr,
+		ADNLKey:             cfg.ADNLKey,
+		Version:             "CLI " + GitCommit,
+		BlockHttp:           *blockHttp,
+		NetworkConfigPath:   *networkConfigPath,
+		Tunnel:              cfg.TunnelConfig,
+		TunnelNetworkConfig: customTinNetCfg,
+		TunnelWeb2:          cfg.TunnelWeb2,
+		TunnelWeb2DoH:       cfg.TunnelWeb2DoH,
+		ShutdownTimeout:     *shutdownTimeout,
+
+		NetworkConfigCacheDir: "./",
+		RoutingRules:          rules,
+		Upstream:              cfg.Upstream,
+		Gateway:               cfg.Gateway,
+		AccessLog:             accessLog,
+		PACDomains:            cfg.PACDomains,
+		AdminAPIToken:         cfg.AdminAPIToken,
+		MetricsListenAddr:     *metricsAddr,
+	}
+	if cfg.Auth != nil {
+		opts.Auth = *cfg.Auth
+	}
+
 	tunnelEnabled := cfg.TunnelConfig != nil && cfg.TunnelConfig.NodesPoolConfigPath != ""
-	closerCtx, stop := context.WithCancel(context.Background())
 
 	var tunnelCtx context.Context
 	if tunnelEnabled {
 		var cancel context.CancelFunc
 		tunnelCtx, cancel = context.WithCancel(context.Background())
-		proxy.OnTunnelStopped = cancel
+		opts.OnTunnelStopped = cancel
 	}
 
+	p := proxy.New(opts)
 	go func() {
-		err = proxy.RunProxy(closerCtx, *addr, cfg.ADNLKey, nil, "CLI "+GitCommit, *blockHttp, *networkConfigPath, cfg.TunnelConfig, customTinNetCfg)
-		if err != nil {
+		if err := p.Start(); err != nil {
+			log.Fatal().Err(err).Msg("proxy failed")
+			return
+		}
+		if err := p.Wait(); err != nil {
 			log.Fatal().Err(err).Msg("proxy failed")
 			return
 		}
@@ -67,12 +157,47 @@ func main() {
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
 	<-c
-	stop()
 
 	log.Info().Msg("Received interrupt signal, shutting down...")
+	go func() {
+		<-c
+		log.Warn().Msg("Received second interrupt signal, exiting without waiting")
+		os.Exit(1)
+	}()
+
+	p.Stop()
+	if err := p.Wait(); err != nil {
+		log.Error().Err(err).Msg("proxy stopped with error")
+	}
 	if tunnelEnabled {
 		log.Info().Msg("Committing tunnel payments...")
 		<-tunnelCtx.Done()
 	}
 	log.Info().Msg("Shutdown complete")
 }
+
+// readPassword - asks password without echo when stdin is terminal, otherwise reads first line of stdin,
+// so it doesn't appear in shell history and process list
+func readPassword() (string, error) {
+	fd := int(os.Stdin.Fd())
+	if term.IsTerminal(fd) {
+		fmt.Fprint(os.Stderr, "Password: ")
+		data, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return "", err
+		}
+		return string(data), nil
+	}
+
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && (!errors.Is(err, io.EOF) || line == "") {
+		return "", err
+	}
+
+	password := strings.TrimRight(line, "\r\n")
+	if password == "" {
+		return "", errors.New("password is empty")
+	}
+	return password, nil
+}
@@ -3,7 +3,6 @@ package main
 import (
 	"context"
 	"crypto/ed25519"
-	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"github.com/rs/zerolog/log"
@@ -16,9 +15,9 @@ import (
 	"github.com/xssnick/tonutils-go/ton"
 	"github.com/xssnick/tonutils-proxy/proxy"
 	"github.com/xssnick/tonutils-proxy/proxy/access"
-	"math/big"
 	"os"
 	"os/exec"
+	"path/filepath"
 	rt "runtime"
 	"sync"
 )
@@ -29,8 +28,11 @@ type App struct {
 
 	proxyStopCtx context.Context
 	proxyStop    context.CancelFunc
+	proxyDone    chan struct{} // closed when proxy is stopped and active downloads are completed
 	statusUpd    chan proxy.State
-	rootPath     string
+	// proxyHooks - tunnel callbacks, other options are set on start
+	proxyHooks proxy.Options
+	rootPath   string
 
 	skipTunnel bool
 
@@ -58,60 +60,40 @@ func NewApp() (*App, error) {
 	tunnelGracefulStopCtx, tunnelGracefulStop := context.WithCancel(context.Background())
 	tunnelGracefulStop()
 
+	proxyDone := make(chan struct{})
+	close(proxyDone)
+
 	a := &App{
 		rootPath:              cfgDir,
 		cfg:                   cfg,
 		proxyStopCtx:          proxyStopCtx,
 		proxyStop:             proxyStop,
+		proxyDone:             proxyDone,
 		tunnelGracefulStopCtx: tunnelGracefulStopCtx,
 		tunnelGracefulStop:    tunnelGracefulStop,
 	}
 
-	proxy.OnAskAccept = func(to, from []*tunnel.SectionInfo) int {
-		var priceIn, priceOut = big.NewInt(0), big.NewInt(0)
-		var sect []SectionInfo
-		for i, n := range append(to, from...) {
-			sect = append(sect, SectionInfo{
-				Name:  base64.StdEncoding.EncodeToString(n.Keys.ReceiverPubKey)[:8],
-				Outer: i == len(to)-1,
-			})
-
-			if n.PaymentInfo != nil {
-				if n.PaymentInfo.ExtraCurrencyID != 0 || n.PaymentInfo.JettonMaster != nil {
-					a.ShowWarnMsg("Route has node with payment in currency other than TON, it is not yet supported in Torrent, rerouting")
-					return tunnel.AcceptorDecisionCancel
-				}
-
-				// consider 1 packet = 512 bytes, actually more, but this is avg payload
-				var packetsPerMB int64 = 2048
-
-				amt := new(big.Int).SetUint64(n.PaymentInfo.PricePerPacket)
-				amt.Mul(amt, big.NewInt(packetsPerMB))
-
-				vcFee := big.NewInt(0)
-				for _, section := range n.PaymentInfo.PaymentTunnel {
-					vcFee.Add(vcFee, section.MinFee)
-				}
-
-				packetsPerChannel := tunnel.ChannelCapacityForNumPayments * tunnel.ChannelPacketsToPrepay
-				// channel fee per 1 mb
-				feeDiv := new(big.Float).Quo(new(big.Float).SetInt64(packetsPerMB), new(big.Float).SetInt64(packetsPerChannel))
+	access.SnapshotPath = filepath.Join(cfgDir, "system-proxy.json")
+	// settings could be left changed when app was not closed properly
+	if restored, err := access.RestorePrevious(); err != nil {
+		log.Error().Err(err).Msg("failed to restore previous system proxy settings")
+	} else if restored {
+		log.Info().Msg("system proxy settings left from previous run were restored")
+	}
 
-				feePer1MB, _ := feeDiv.Mul(new(big.Float).SetInt(vcFee), feeDiv).Int(vcFee)
-				amt.Add(amt, feePer1MB)
+	a.proxyHooks.OnAskAccept = func(to, from []*tunnel.SectionInfo) int {
+		route, err := proxy.DescribeRoute(to, from)
+		if err != nil {
+			a.ShowWarnMsg("Route has node with payment in currency other than TON, it is not yet supported in Torrent, rerouting")
+			return tunnel.AcceptorDecisionCancel
+		}
 
-				if i < len(to)-1 {
-					priceOut.Add(priceOut, amt)
-				} else if i == len(to)-1 {
-					priceOut.Add(priceOut, amt)
-					priceIn.Add(priceOut, amt)
-				} else {
-					priceIn.Add(priceOut, amt)
-				}
-			}
+		var sect []SectionInfo
+		for _, n := range route.Sections {
+			sect = append(sect, SectionInfo{Name: n.Name, Outer: n.Outer})
 		}
 
-		runtime.EventsEmit(a.ctx, "tunnel_check", sect, tlb.FromNanoTON(priceIn).String(), tlb.FromNanoTON(priceOut).String())
+		runtime.EventsEmit(a.ctx, "tunnel_check", sect, route.PriceIn, route.PriceOut)
 
 		ch := make(chan int, 1)
 		runtime.EventsOn(a.ctx, "tunnel_check_result", func(optionalData ...interface{}) {
@@ -142,7 +124,7 @@ func NewApp() (*App, error) {
 		}
 	}
 
-	proxy.OnAskReroute = func() bool {
+	a.proxyHooks.OnAskReroute = func() bool {
 		runtime.EventsEmit(a.ctx, "tunnel_reinit_ask")
 
 		ch := make(chan bool, 1)
@@ -159,15 +141,15 @@ func NewApp() (*App, error) {
 		}
 	}
 
-	proxy.OnPaidUpdate = func(paid tlb.Coins) {
+	a.proxyHooks.OnPaidUpdate = func(paid tlb.Coins) {
 		runtime.EventsEmit(a.ctx, "tunnel_paid", paid.String())
 	}
 
-	proxy.OnTunnel = func(addr string) {
+	a.proxyHooks.OnTunnel = func(addr string) {
 		runtime.EventsEmit(a.ctx, "tunnel_updated", addr)
 	}
 
-	proxy.OnTunnelStopped = func() {
+	a.proxyHooks.OnTunnelStopped = func() {
 		a.tunnelGracefulStop()
 	}
 
@@ -245,9 +227,22 @@ func (a *App) startup(ctx context.Context) {
 			if state.Stopped {
 				a.proxyStop()
 			} else if state.Type == "ready" {
-				if err := access.SetProxy(a.cfg.ProxyListenAddr); err != nil {
+				setSystemProxy := access.SetProxy
+				if a.cfg.UsePAC {
+					setSystemProxy = func(addr string) error {
+						return access.SetPAC(proxy.PACURL(addr))
+					}
+				}
+
+				if err := setSystemProxy(a.cfg.ProxyListenAddr); err != nil {
 					println(err.Error())
 				} else {
+					if !a.cfg.DisableWatchdog {
+						if err = access.StartWatchdog(); err != nil {
+							log.Warn().Err(err).Msg("failed to start system proxy watchdog")
+						}
+					}
+
 					openOnce.Do(func() {
 						openbrowser("http://foundation.ton/")
 					})
@@ -266,6 +261,9 @@ func (a *App) shutdown(ctx context.Context) {
 		_ = access.ClearProxy()
 	}
 
+	log.Info().Msg("waiting for active downloads")
+	<-a.proxyDone
+
 	log.Info().Msg("waiting for graceful stop")
 	<-a.tunnelGracefulStopCtx.Done()
 	log.Info().Msg("gracefully stopped")
@@ -381,9 +379,14 @@ func (a *App) StartProxy() {
 	}
 
 	a.proxyStopCtx, a.proxyStop = context.WithCancel(a.ctx)
+	done := make(chan struct{})
+	a.proxyDone = done
 
 	go func() {
-		defer a.StopProxy()
+		defer func() {
+			close(done)
+			a.StopProxy()
+		}()
 
 		var err error
 		var customTunNetCfg *liteclient.GlobalConfig
@@ -402,7 +405,28 @@ func (a *App) StartProxy() {
 		}
 
 	retry:
-		err = proxy.RunProxy(a.proxyStopCtx, a.cfg.ProxyListenAddr, a.cfg.ADNLKey, a.statusUpd, "GUI 1.7", false, "", tun, customTunNetCfg)
+		opts := a.proxyHooks
+		opts.ListenAddr = a.cfg.ProxyListenAddr
+		opts.ADNLKey = a.cfg.ADNLKey
+		opts.Version = "GUI 1.7"
+		opts.Tunnel = tun
+		opts.TunnelNetworkConfig = customTunNetCfg
+		opts.NetworkConfigCacheDir = a.rootPath
+		opts.OnState = func(state proxy.State) {
+			a.statusUpd <- state
+		}
+
+		p := proxy.New(opts)
+		stopCtx := a.proxyStopCtx
+		go func() {
+			<-stopCtx.Done()
+			p.Stop()
+		}()
+
+		err = p.Start()
+		if err == nil {
+			err = p.Wait()
+		}
 		if err != nil {
 			if a.skipTunnel {
 				a.skipTunnel = false
@@ -429,6 +453,9 @@ func (a *App) StopProxy() {
 		_ = access.ClearProxy()
 	}
 
+	// active downloads are completed before stop
+	<-a.proxyDone
+
 	runtime.EventsEmit(a.ctx, "statusUpdate", "stopped", "stopped")
 }
 
@@ -19,6 +19,11 @@ type Config struct {
 	CustomTunnelNetworkConfigPath string
 	TunnelConfig                  *tunnelConfig.ClientConfig
 
+	// UsePAC - configure system with pac file, to send only ton sites through proxy
+	UsePAC bool
+	// DisableWatchdog - do not start watchdog process, which restores system proxy settings when app is killed
+	DisableWatchdog bool
+
 	mx sync.Mutex
 }
 
@@ -7,6 +7,8 @@ import (
 	"github.com/wailsapp/wails/v2/pkg/options"
 	"github.com/wailsapp/wails/v2/pkg/options/assetserver"
 	"github.com/wailsapp/wails/v2/pkg/options/mac"
+	"github.com/xssnick/tonutils-proxy/proxy/access"
+	"os"
 	"runtime"
 )
 
@@ -14,6 +16,10 @@ import (
 var assets embed.FS
 
 func main() {
+	if access.RunWatchdog(os.Args[1:]) {
+		return
+	}
+
 	// Create an instance of the app structure
 	app, err := NewApp()
 	if err != nil {
@@ -0,0 +1,274 @@
+package mobile
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"github.com/ton-blockchain/adnl-tunnel/tunnel"
+	"github.com/xssnick/tonutils-go/tlb"
+	"github.com/xssnick/tonutils-proxy/proxy"
+	"io"
+	"net/http"
+	"sync"
+)
+
+var ErrAlreadyStarted = proxy.ErrAlreadyStarted
+
+// Proxy - ton proxy instance, methods are safe to call from any thread
+type Proxy struct {
+	stateListener  StateListener
+	tunnelListener TunnelListener
+
+	proxy    *proxy.Proxy
+	starting bool
+
+	mx sync.Mutex
+}
+
+// NewProxy - creates stopped proxy
+func NewProxy() *Proxy {
+	return &Proxy{}
+}
+
+// SetStateListener - sets listener of loading states, nil removes it
+func (p *Proxy) SetStateListener(l StateListener) {
+	p.mx.Lock()
+	p.stateListener = l
+	p.mx.Unlock()
+}
+
+// SetTunnelListener - sets listener of tunnel events, without it routes are accepted automatically
+func (p *Proxy) SetTunnelListener(l TunnelListener) {
+	p.mx.Lock()
+	p.tunnelListener = l
+	p.mx.Unlock()
+}
+
+// Start - starts proxy and blocks until it is ready or failed, should not be called from main thread
+func (p *Proxy) Start(opts *Options) error {
+	if opts == nil {
+		opts = NewOptions()
+	}
+
+	cfg := proxy.Options{
+		ListenAddr:       opts.ListenAddr,
+		Version:          "MOBILE " + GitCommit,
+		BlockHttp:        opts.BlockHttp,
+		NetworkConfigURL: opts.NetworkConfigURL,
+
+		OnState:         p.onState,
+		OnTunnel:        p.onTunnel,
+		OnPaidUpdate:    p.onPaid,
+		OnTunnelStopped: p.onTunnelStopped,
+		OnAskAccept:     p.askAccept,
+		OnAskReroute:    p.askReroute,
+	}
+	if opts.NoListener {
+		cfg.ListenAddr = ""
+	} else if cfg.ListenAddr == "" {
+		cfg.ListenAddr = NewOptions().ListenAddr
+	}
+
+	if len(opts.ADNLKey) > 0 {
+		if len(opts.ADNLKey) != ed25519.SeedSize {
+			return fmt.Errorf("adnl key should be %d bytes seed", ed25519.SeedSize)
+		}
+		cfg.ADNLKey = ed25519.NewKeyFromSeed(opts.ADNLKey)
+	}
+
+	if err := parseJSON(opts.NetworkConfigJSON, &cfg.NetworkConfig); err != nil {
+		return fmt.Errorf("failed to parse network config: %w", err)
+	}
+	if err := parseJSON(opts.TunnelConfigJSON, &cfg.Tunnel); err != nil {
+		return fmt.Errorf("failed to parse tunnel config: %w", err)
+	}
+	if err := parseJSON(opts.TunnelNetworkConfigJSON, &cfg.TunnelNetworkConfig); err != nil {
+		return fmt.Errorf("failed to parse tunnel network config: %w", err)
+	}
+
+	p.mx.Lock()
+	if p.starting || (p.proxy != nil && !p.proxy.State().Stopped) {
+		p.mx.Unlock()
+		return ErrAlreadyStarted
+	}
+	p.starting = true
+	p.proxy = proxy.New(cfg)
+	prx := p.proxy
+	p.mx.Unlock()
+
+	err := prx.Start()
+
+	p.mx.Lock()
+	p.starting = false
+	p.mx.Unlock()
+
+	if err != nil {
+		log.Error().Err(err).Msg("failed to start proxy")
+		return err
+	}
+	return nil
+}
+
+// Stop - stops proxy and waits until it is stopped, does nothing when it is not started
+func (p *Proxy) Stop() {
+	prx := p.getProxy()
+	if prx == nil {
+		return
+	}
+	prx.Stop()
+	_ = prx.Wait()
+}
+
+// IsRunning - true when proxy is started and not yet stopped
+func (p *Proxy) IsRunning() bool {
+	prx := p.getProxy()
+	if prx == nil {
+		return false
+	}
+	_, running := prx.Status()
+	return running
+}
+
+// Status - returns current state of proxy
+func (p *Proxy) Status() *Status {
+	prx := p.getProxy()
+	if prx == nil {
+		return &Status{State: &State{Type: "stopped", State: "not started", Stopped: true}}
+	}
+
+	st := prx.State()
+	res := &Status{State: &State{Type: st.Type, State: st.State, Stopped: st.Stopped}}
+	if s, ok := prx.Status(); ok {
+		res.Running = true
+		if data, err := json.Marshal(s); err == nil {
+			res.DetailsJSON = string(data)
+		}
+	}
+	return res
+}
+
+// Fetch - makes http request through running proxy in process, headersJSON is {"Name": ["value"]} or empty,
+// redirects are not followed
+func (p *Proxy) Fetch(method, url, headersJSON string, body []byte) (*Response, error) {
+	prx := p.getProxy()
+	if prx == nil {
+		return nil, proxy.ErrNotRunning
+	}
+
+	if method == "" {
+		method = http.MethodGet
+	}
+
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("invalid request: %w", err)
+	}
+
+	var headers http.Header
+	if err = parseJSON(headersJSON, &headers); err != nil {
+		return nil, fmt.Errorf("failed to parse headers: %w", err)
+	}
+	for k, v := range headers {
+		req.Header[http.CanonicalHeaderKey(k)] = v
+	}
+
+	resp, err := prx.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read body: %w", err)
+	}
+
+	respHeaders, err := json.Marshal(resp.Header)
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize headers: %w", err)
+	}
+
+	return &Response{
+		Status:      resp.StatusCode,
+		HeadersJSON: string(respHeaders),
+		Body:        data,
+	}, nil
+}
+
+// SetLogLevel - changes log level, one of: trace, debug, info, warn, error, disabled
+func SetLogLevel(level string) error {
+	_, err := proxy.SetLogLevel(level)
+	return err
+}
+
+func (p *Proxy) onState(st proxy.State) {
+	p.mx.Lock()
+	l := p.stateListener
+	p.mx.Unlock()
+
+	if l != nil {
+		l.OnState(&State{Type: st.Type, State: st.State, Stopped: st.Stopped})
+	}
+}
+
+func (p *Proxy) onTunnel(addr string) {
+	if l := p.getTunnelListener(); l != nil {
+		l.OnTunnel(addr)
+	}
+}
+
+func (p *Proxy) onPaid(paid tlb.Coins) {
+	if l := p.getTunnelListener(); l != nil {
+		l.OnPaid(paid.String())
+	}
+}
+
+func (p *Proxy) onTunnelStopped() {
+	if l := p.getTunnelListener(); l != nil {
+		l.OnTunnelStopped()
+	}
+}
+
+func (p *Proxy) askAccept(to, from []*tunnel.SectionInfo) int {
+	l := p.getTunnelListener()
+	if l == nil {
+		return TunnelAccept
+	}
+
+	route, err := proxy.DescribeRoute(to, from)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to describe tunnel route")
+		return TunnelCancel
+	}
+	return l.AcceptRoute(&Route{PriceIn: route.PriceIn, PriceOut: route.PriceOut, sections: route.Sections})
+}
+
+func (p *Proxy) askReroute() bool {
+	l := p.getTunnelListener()
+	if l == nil {
+		return false
+	}
+	return l.Reroute()
+}
+
+func (p *Proxy) getTunnelListener() TunnelListener {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	return p.tunnelListener
+}
+
+func (p *Proxy) getProxy() *proxy.Proxy {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	return p.proxy
+}
+
+// parseJSON - unmarshals data to v, empty data is skipped
+func parseJSON(data string, v any) error {
+	if data == "" {
+		return nil
+	}
+	return json.Unmarshal([]byte(data), v)
+}
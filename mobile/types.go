@@ -0,0 +1,114 @@
+// Package mobile - proxy api for gomobile bind, generates Kotlin and Swift bindings:
+// go tool gomobile bind -target=android ./mobile
+package mobile
+
+import (
+	"github.com/ton-blockchain/adnl-tunnel/tunnel"
+	"github.com/xssnick/tonutils-proxy/proxy"
+)
+
+var GitCommit string
+
+// Tunnel route decisions, returned from TunnelListener.AcceptRoute
+const (
+	// TunnelCancel - start without tunnel
+	TunnelCancel = tunnel.AcceptorDecisionCancel
+	TunnelAccept = tunnel.AcceptorDecisionAccept
+	// TunnelReject - try another route
+	TunnelReject = tunnel.AcceptorDecisionReject
+)
+
+// Options - proxy start options, all fields are optional
+type Options struct {
+	// ListenAddr - address to listen on, 127.0.0.1:8080 by default
+	ListenAddr string
+	// NoListener - do not listen on any address, requests are made only with Proxy.Fetch
+	NoListener bool
+	// NetworkConfigJSON - ton network config, downloaded when empty
+	NetworkConfigJSON string
+	// NetworkConfigURL - config is refreshed from it periodically, passed config is refreshed only when it is set
+	NetworkConfigURL string
+	// ADNLKey - 32 bytes seed of ed25519 key, random key is used when empty
+	ADNLKey []byte
+	// TunnelConfigJSON - adnl tunnel client config, tunnel is not used when empty
+	TunnelConfigJSON string
+	// TunnelNetworkConfigJSON - custom network config for tunnel payments
+	TunnelNetworkConfigJSON string
+	BlockHttp               bool
+}
+
+// NewOptions - returns default options
+func NewOptions() *Options {
+	return &Options{
+		ListenAddr: "127.0.0.1:8080",
+	}
+}
+
+// State - loading state of proxy, Type is one of: loading, ready, error, stopped
+type State struct {
+	Type    string
+	State   string
+	Stopped bool
+}
+
+// Status - current state of proxy, DetailsJSON contains sites, bags and tunnel info when proxy is running
+type Status struct {
+	Running     bool
+	State       *State
+	DetailsJSON string
+}
+
+// RouteSection - node of proposed tunnel route
+type RouteSection struct {
+	// Name - short id of node
+	Name string
+	// Outer - exit node of the tunnel
+	Outer bool
+}
+
+// Route - tunnel route proposed for acceptance, prices are in TON per 1 MB
+type Route struct {
+	PriceIn  string
+	PriceOut string
+
+	sections []proxy.RouteSection
+}
+
+// SectionsCount - number of nodes in route
+func (r *Route) SectionsCount() int {
+	return len(r.sections)
+}
+
+// Section - returns node of route by index, nil when index is out of range
+func (r *Route) Section(i int) *RouteSection {
+	if i < 0 || i >= len(r.sections) {
+		return nil
+	}
+	return &RouteSection{Name: r.sections[i].Name, Outer: r.sections[i].Outer}
+}
+
+// StateListener - receives loading states, called from background threads
+type StateListener interface {
+	OnState(state *State)
+}
+
+// TunnelListener - receives tunnel events and decides on routes, called from background threads
+type TunnelListener interface {
+	// OnTunnel - external address of tunnel changed
+	OnTunnel(addr string)
+	// OnPaid - total amount paid for tunnel in TON
+	OnPaid(paid string)
+	OnTunnelStopped()
+	// AcceptRoute - should return one of TunnelCancel, TunnelAccept, TunnelReject, blocks proxy start until answered
+	AcceptRoute(route *Route) int
+	// Reroute - tunnel is broken, return true to build new route, false to wait
+	Reroute() bool
+}
+
+// Response - result of Proxy.Fetch
+type Response struct {
+	Status int
+	// HeadersJSON - {"Name": ["value"]}
+	HeadersJSON string
+	Body        []byte
+}
@@ -4,6 +4,7 @@ package access
 
 import "C"
 import (
+	"errors"
 	"sync"
 	"unsafe"
 )
@@ -23,6 +24,8 @@ import (
 
 char* proxyHost;
 char* proxyPort;
+char* pacURL;
+bool pacMode;
 
 enum RET_ERRORS {
   RET_NO_ERROR = 0,
@@ -61,6 +64,26 @@ Boolean toggleAction(SCNetworkProtocolRef proxyProtocolRef, NSDictionary* oldPre
   return success;
 }
 
+Boolean togglePacAction(SCNetworkProtocolRef proxyProtocolRef, NSDictionary* oldPreferences, bool turnOn) {
+  NSString* nsPacURL = [[NSString alloc] initWithCString: pacURL encoding:NSUTF8StringEncoding];
+  NSMutableDictionary *newPreferences = [NSMutableDictionary dictionaryWithDictionary: oldPreferences];
+  Boolean success;
+
+  if (turnOn) {
+    [newPreferences setValue: nsPacURL forKey:(NSString*)kSCPropNetProxiesProxyAutoConfigURLString];
+    [newPreferences setValue:[NSNumber numberWithInt:1] forKey:(NSString*)kSCPropNetProxiesProxyAutoConfigEnable];
+  } else if ([nsPacURL isEqualToString:[newPreferences valueForKey:(NSString*)kSCPropNetProxiesProxyAutoConfigURLString]]) {
+    [newPreferences setValue:[NSNumber numberWithInt:0] forKey:(NSString*)kSCPropNetProxiesProxyAutoConfigEnable];
+    [newPreferences removeObjectForKey:(NSString*)kSCPropNetProxiesProxyAutoConfigURLString];
+  }
+
+  success = SCNetworkProtocolSetConfiguration(proxyProtocolRef, (__bridge CFDictionaryRef)newPreferences);
+  if(!success) {
+    NSLog(@"Failed to set Protocol Configuration");
+  }
+  return success;
+}
+
 int toggle(bool turnOn, AuthorizationRef auth) {
   int ret = RET_NO_ERROR;
   Boolean success;
@@ -110,7 +133,11 @@ int toggle(bool turnOn, AuthorizationRef auth) {
     }
 
     oldPreferences = (__bridge NSDictionary*)SCNetworkProtocolGetConfiguration(proxyProtocolRef);
-    if (!toggleAction(proxyProtocolRef, oldPreferences, turnOn)) {
+    if (pacMode) {
+      if (!togglePacAction(proxyProtocolRef, oldPreferences, turnOn)) {
+        ret = SYSCALL_FAILED;
+      }
+    } else if (!toggleAction(proxyProtocolRef, oldPreferences, turnOn)) {
       ret = SYSCALL_FAILED;
     }
 
@@ -145,6 +172,139 @@ freePrefsRef:
   return ret;
 }
 
+// copyProxySettings - returns json with proxy settings of every network service by service id, should be freed
+char* copyProxySettings() {
+  char* out = NULL;
+
+  @autoreleasepool {
+    SCPreferencesRef prefsRef = SCPreferencesCreate(NULL, CFSTR("org.tonutils.proxy"), NULL);
+    if (prefsRef == NULL) {
+      NSLog(@"Fail to obtain Preferences Ref");
+      return NULL;
+    }
+
+    SCNetworkSetRef networkSetRef = SCNetworkSetCopyCurrent(prefsRef);
+    if (networkSetRef == NULL) {
+      NSLog(@"Fail to get available network services");
+      CFRelease(prefsRef);
+      return NULL;
+    }
+
+    NSMutableDictionary *result = [NSMutableDictionary dictionary];
+    CFArrayRef networkServicesArrayRef = SCNetworkSetCopyServices(networkSetRef);
+    for (long i = 0; networkServicesArrayRef != NULL && i < CFArrayGetCount(networkServicesArrayRef); i++) {
+      SCNetworkServiceRef networkServiceRef = CFArrayGetValueAtIndex(networkServicesArrayRef, i);
+      SCNetworkProtocolRef proxyProtocolRef = SCNetworkServiceCopyProtocol(networkServiceRef, kSCNetworkProtocolTypeProxies);
+      if (proxyProtocolRef == NULL) {
+        continue;
+      }
+
+      NSDictionary *preferences = (__bridge NSDictionary*)SCNetworkProtocolGetConfiguration(proxyProtocolRef);
+      NSString *serviceID = (__bridge NSString*)SCNetworkServiceGetServiceID(networkServiceRef);
+      [result setValue:(preferences != nil ? preferences : [NSNull null]) forKey:serviceID];
+      CFRelease(proxyProtocolRef);
+    }
+
+    if (networkServicesArrayRef != NULL) {
+      CFRelease(networkServicesArrayRef);
+    }
+    CFRelease(networkSetRef);
+    CFRelease(prefsRef);
+
+    if (![NSJSONSerialization isValidJSONObject:result]) {
+      NSLog(@"Proxy settings cannot be serialized");
+      return NULL;
+    }
+
+    NSData *data = [NSJSONSerialization dataWithJSONObject:result options:0 error:nil];
+    if (data == nil) {
+      return NULL;
+    }
+
+    out = malloc([data length] + 1);
+    if (out == NULL) {
+      return NULL;
+    }
+    memcpy(out, [data bytes], [data length]);
+    out[[data length]] = 0;
+  }
+  return out;
+}
+
+// restoreProxySettings - sets proxy settings of network services from json made by copyProxySettings
+int restoreProxySettings(char* json, AuthorizationRef auth) {
+  int ret = RET_NO_ERROR;
+
+  @autoreleasepool {
+    NSData *data = [NSData dataWithBytes:json length:strlen(json)];
+    NSDictionary *saved = [NSJSONSerialization JSONObjectWithData:data options:0 error:nil];
+    if (![saved isKindOfClass:[NSDictionary class]]) {
+      return INVALID_FORMAT;
+    }
+
+    SCPreferencesRef prefsRef = SCPreferencesCreateWithAuthorization(NULL, CFSTR("org.tonutils.proxy"), NULL, auth);
+    if (prefsRef == NULL) {
+      NSLog(@"Fail to obtain Preferences Ref");
+      return NO_PERMISSION;
+    }
+
+    if (!SCPreferencesLock(prefsRef, true)) {
+      NSLog(@"Fail to obtain PreferencesLock");
+      CFRelease(prefsRef);
+      return NO_PERMISSION;
+    }
+
+    SCNetworkSetRef networkSetRef = SCNetworkSetCopyCurrent(prefsRef);
+    if (networkSetRef == NULL) {
+      NSLog(@"Fail to get available network services");
+      SCPreferencesUnlock(prefsRef);
+      CFRelease(prefsRef);
+      return SYSCALL_FAILED;
+    }
+
+    CFArrayRef networkServicesArrayRef = SCNetworkSetCopyServices(networkSetRef);
+    for (long i = 0; networkServicesArrayRef != NULL && i < CFArrayGetCount(networkServicesArrayRef); i++) {
+      SCNetworkServiceRef networkServiceRef = CFArrayGetValueAtIndex(networkServicesArrayRef, i);
+      NSString *serviceID = (__bridge NSString*)SCNetworkServiceGetServiceID(networkServiceRef);
+      id preferences = [saved objectForKey:serviceID];
+      if (preferences == nil) {
+        // service was added after snapshot, we have not changed it
+        continue;
+      }
+
+      SCNetworkProtocolRef proxyProtocolRef = SCNetworkServiceCopyProtocol(networkServiceRef, kSCNetworkProtocolTypeProxies);
+      if (proxyProtocolRef == NULL) {
+        NSLog(@"Couldn't acquire copy of proxyProtocol");
+        ret = SYSCALL_FAILED;
+        continue;
+      }
+
+      CFDictionaryRef config = preferences == [NSNull null] ? NULL : (__bridge CFDictionaryRef)preferences;
+      if (!SCNetworkProtocolSetConfiguration(proxyProtocolRef, config)) {
+        NSLog(@"Failed to set Protocol Configuration");
+        ret = SYSCALL_FAILED;
+      }
+      CFRelease(proxyProtocolRef);
+    }
+
+    if (!SCPreferencesCommitChanges(prefsRef)) {
+      NSLog(@"Failed to Commit Changes");
+      ret = SYSCALL_FAILED;
+    } else if (!SCPreferencesApplyChanges(prefsRef)) {
+      NSLog(@"Failed to Apply Changes");
+      ret = SYSCALL_FAILED;
+    }
+
+    if (networkServicesArrayRef != NULL) {
+      CFRelease(networkServicesArrayRef);
+    }
+    CFRelease(networkSetRef);
+    SCPreferencesUnlock(prefsRef);
+    CFRelease(prefsRef);
+  }
+  return ret;
+}
+
 AuthorizationRef auth() {
     AuthorizationRef a;
     OSStatus status = AuthorizationCreate(
@@ -165,14 +325,21 @@ int setProxy(char* host, char* port, bool enabled, AuthorizationRef auth) {
 
     return toggle(enabled, auth);
 }
+
+int setPac(char* url, bool enabled, AuthorizationRef auth) {
+	pacURL = url;
+	pacMode = true;
+
+	int ret = toggle(enabled, auth);
+	pacMode = false;
+	return ret;
+}
 */
 import "C"
 
 var authP C.AuthorizationRef
 var once sync.Once
 
-var setAddr, setPort string
-
 func auth() {
 	once.Do(func() {
 		authP = C.auth()
@@ -182,9 +349,6 @@ func auth() {
 func enableProxy(addr, port string) error {
 	auth()
 
-	setAddr = addr
-	setPort = port
-
 	cAddr := C.CString(addr)
 	defer C.free(unsafe.Pointer(cAddr))
 
@@ -197,19 +361,62 @@ func enableProxy(addr, port string) error {
 	return nil
 }
 
-func disableProxy() error {
-	if authP == nil { // proxy was not set
+func enablePAC(url string) error {
+	auth()
+
+	cURL := C.CString(url)
+	defer C.free(unsafe.Pointer(cURL))
+
+	if C.setPac(cURL, C.bool(true), authP) != 0 {
+		return errors.New("failed to set proxy auto config url")
+	}
+	return nil
+}
+
+// disableProxy - switches off proxy server or pac url of network services, only where they are still the ones we set
+func disableProxy(a *applied) error {
+	auth()
+
+	if a.PAC != "" {
+		cURL := C.CString(a.PAC)
+		defer C.free(unsafe.Pointer(cURL))
+
+		if C.setPac(cURL, C.bool(false), authP) != 0 {
+			return errors.New("failed to disable proxy auto config url")
+		}
 		return nil
 	}
 
-	cAddr := C.CString(setAddr)
+	cAddr := C.CString(a.Host)
 	defer C.free(unsafe.Pointer(cAddr))
 
-	cPort := C.CString(setPort)
+	cPort := C.CString(a.Port)
 	defer C.free(unsafe.Pointer(cPort))
 
-	enable := C.bool(false)
-	C.setProxy(cAddr, cPort, enable, authP)
+	if C.setProxy(cAddr, cPort, C.bool(false), authP) != 0 {
+		return errors.New("failed to disable proxy")
+	}
+	return nil
+}
+
+func saveSettings() ([]byte, error) {
+	cJSON := C.copyProxySettings()
+	if cJSON == nil {
+		return nil, errors.New("failed to read proxy settings of network services")
+	}
+	defer C.free(unsafe.Pointer(cJSON))
+
+	return []byte(C.GoString(cJSON)), nil
+}
 
+func restoreSettings(data []byte) error {
+	auth()
+
+	cJSON := C.CString(string(data))
+	defer C.free(unsafe.Pointer(cJSON))
+
+	if C.restoreProxySettings(cJSON, authP) != 0 {
+		return errors.New("failed to restore proxy settings of network services")
+	}
 	return nil
 }
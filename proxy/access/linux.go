@@ -2,15 +2,366 @@
 
 package access
 
-import "C"
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
 )
 
+const (
+	desktopGNOME = "gnome"
+	desktopKDE   = "kde"
+	desktopEnv   = "env"
+)
+
+// linuxSettings - proxy settings of desktop, values are kept exactly as they were read, to restore them as is
+type linuxSettings struct {
+	Desktop string
+	Values  map[string]string
+	// Missing - keys which were not set at all, they are deleted on restore
+	Missing []string
+}
+
+type linuxBackend interface {
+	// read - returns current values of keys which we change
+	read() (*linuxSettings, error)
+	// write - sets values and deletes missing keys
+	write(s *linuxSettings) error
+	proxy(host, port string) (map[string]string, error)
+	pac(url string) (map[string]string, error)
+	// off - returns settings which switch proxy off
+	off() *linuxSettings
+}
+
+func saveSettings() ([]byte, error) {
+	desktop := detectDesktop()
+	s, err := backendFor(desktop).read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s proxy settings: %w", desktop, err)
+	}
+	s.Desktop = desktop
+	return json.Marshal(s)
+}
+
+func restoreSettings(data []byte) error {
+	var s linuxSettings
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+
+	if err := backendFor(s.Desktop).write(&s); err != nil {
+		return fmt.Errorf("failed to write %s proxy settings: %w", s.Desktop, err)
+	}
+	return nil
+}
+
 func enableProxy(addr, port string) error {
-	return errors.New("automatic system configuration is not yet implemented for your platform")
+	return apply(func(b linuxBackend) (map[string]string, error) {
+		return b.proxy(addr, port)
+	})
+}
+
+func enablePAC(url string) error {
+	return apply(func(b linuxBackend) (map[string]string, error) {
+		return b.pac(url)
+	})
+}
+
+// disableProxy - switches proxy off, only when settings are still the ones we set
+func disableProxy(a *applied) error {
+	desktop := detectDesktop()
+	b := backendFor(desktop)
+
+	var ours map[string]string
+	var err error
+	if a.PAC != "" {
+		ours, err = b.pac(a.PAC)
+	} else {
+		ours, err = b.proxy(a.Host, a.Port)
+	}
+	if err != nil {
+		return err
+	}
+
+	cur, err := b.read()
+	if err != nil {
+		return fmt.Errorf("failed to read %s proxy settings: %w", desktop, err)
+	}
+	for k, v := range ours {
+		if cur.Values[k] != v {
+			// changed by someone else
+			return nil
+		}
+	}
+
+	if err = b.write(b.off()); err != nil {
+		return fmt.Errorf("failed to write %s proxy settings: %w", desktop, err)
+	}
+	return nil
+}
+
+func apply(values func(b linuxBackend) (map[string]string, error)) error {
+	desktop := detectDesktop()
+	b := backendFor(desktop)
+
+	vals, err := values(b)
+	if err != nil {
+		return err
+	}
+
+	if err = b.write(&linuxSettings{Desktop: desktop, Values: vals}); err != nil {
+		return fmt.Errorf("failed to set %s proxy settings: %w", desktop, err)
+	}
+	return nil
+}
+
+// detectDesktop - returns desktop which settings are used by browsers,
+// environment file is used when desktop is unknown or its tools are not installed
+func detectDesktop() string {
+	desktop := strings.ToLower(os.Getenv("XDG_CURRENT_DESKTOP") + ":" + os.Getenv("DESKTOP_SESSION"))
+
+	if strings.Contains(desktop, "kde") || strings.Contains(desktop, "plasma") {
+		if kdeTools() != nil {
+			return desktopKDE
+		}
+	}
+
+	for _, d := range []string{"gnome", "unity", "cinnamon", "budgie", "pantheon", "ubuntu", "pop"} {
+		if strings.Contains(desktop, d) {
+			if exec.Command("gsettings", "list-keys", "org.gnome.system.proxy").Run() == nil {
+				return desktopGNOME
+			}
+			break
+		}
+	}
+	return desktopEnv
+}
+
+func backendFor(desktop string) linuxBackend {
+	switch desktop {
+	case desktopGNOME:
+		return gnomeBackend{}
+	case desktopKDE:
+		if t := kdeTools(); t != nil {
+			return *t
+		}
+		// keep working with config file name, so error will be reported on use
+		return kdeBackend{readTool: "kreadconfig5", writeTool: "kwriteconfig5"}
+	}
+	return envBackend{path: envFilePath()}
+}
+
+func run(name string, args ...string) (string, error) {
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("%s failed: %w, output: %s", name, err, strings.TrimSpace(string(out)))
+	}
+	return strings.TrimRight(string(out), "\n"), nil
+}
+
+// gnomeBackend - gsettings of gnome and desktops based on it, values are in GVariant format
+type gnomeBackend struct{}
+
+// gnomeKeys - mode goes last, to switch it when everything else is already set
+var gnomeKeys = []string{
+	"org.gnome.system.proxy.http host",
+	"org.gnome.system.proxy.http port",
+	"org.gnome.system.proxy autoconfig-url",
+	"org.gnome.system.proxy mode",
+}
+
+func (g gnomeBackend) read() (*linuxSettings, error) {
+	s := &linuxSettings{Values: map[string]string{}}
+	for _, k := range gnomeKeys {
+		schema, key, _ := strings.Cut(k, " ")
+		v, err := run("gsettings", "get", schema, key)
+		if err != nil {
+			return nil, err
+		}
+		s.Values[k] = v
+	}
+	return s, nil
+}
+
+func (g gnomeBackend) write(s *linuxSettings) error {
+	for _, k := range gnomeKeys {
+		v, ok := s.Values[k]
+		if !ok {
+			continue
+		}
+
+		schema, key, _ := strings.Cut(k, " ")
+		if _, err := run("gsettings", "set", schema, key, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (g gnomeBackend) proxy(host, port string) (map[string]string, error) {
+	return map[string]string{
+		"org.gnome.system.proxy.http host": gvariantString(host),
+		"org.gnome.system.proxy.http port": port,
+		"org.gnome.system.proxy mode":      gvariantString("manual"),
+	}, nil
+}
+
+func (g gnomeBackend) pac(url string) (map[string]string, error) {
+	return map[string]string{
+		"org.gnome.system.proxy autoconfig-url": gvariantString(url),
+		"org.gnome.system.proxy mode":           gvariantString("auto"),
+	}, nil
+}
+
+func (g gnomeBackend) off() *linuxSettings {
+	return &linuxSettings{Values: map[string]string{"org.gnome.system.proxy mode": gvariantString("none")}}
+}
+
+func gvariantString(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + "'"
+}
+
+// kdeBackend - kioslaverc of kde, edited with kreadconfig and kwriteconfig of installed plasma version
+type kdeBackend struct {
+	readTool  string
+	writeTool string
+}
+
+const kdeGroup = "Proxy Settings"
+
+var kdeKeys = []string{"httpProxy", "Proxy Config Script", "ProxyType"}
+
+func kdeTools() *kdeBackend {
+	for _, v := range []string{"6", "5"} {
+		r, w := "kreadconfig"+v, "kwriteconfig"+v
+		if _, err := exec.LookPath(w); err != nil {
+			continue
+		}
+		if _, err := exec.LookPath(r); err != nil {
+			continue
+		}
+		return &kdeBackend{readTool: r, writeTool: w}
+	}
+	return nil
+}
+
+func (k kdeBackend) read() (*linuxSettings, error) {
+	s := &linuxSettings{Values: map[string]string{}}
+	for _, key := range kdeKeys {
+		v, err := run(k.readTool, "--file", "kioslaverc", "--group", kdeGroup, "--key", key)
+		if err != nil {
+			return nil, err
+		}
+
+		if v == "" {
+			s.Missing = append(s.Missing, key)
+			continue
+		}
+		s.Values[key] = v
+	}
+	return s, nil
+}
+
+func (k kdeBackend) write(s *linuxSettings) error {
+	for _, key := range kdeKeys {
+		args := []string{"--file", "kioslaverc", "--group", kdeGroup, "--key", key}
+		if v, ok := s.Values[key]; ok {
+			args = append(args, v)
+		} else if slices.Contains(s.Missing, key) {
+			args = append(args, "--delete")
+		} else {
+			continue
+		}
+
+		if _, err := run(k.writeTool, args...); err != nil {
+			return err
+		}
+	}
+
+	// ask running applications to reload proxy settings
+	_, _ = run("dbus-send", "--type=signal", "/KIO/Scheduler", "org.kde.KIO.Scheduler.reparseSlaveConfiguration", "string:")
+	return nil
+}
+
+func (k kdeBackend) proxy(host, port string) (map[string]string, error) {
+	return map[string]string{
+		"httpProxy": "http://" + host + " " + port,
+		"ProxyType": "1",
+	}, nil
+}
+
+func (k kdeBackend) pac(url string) (map[string]string, error) {
+	return map[string]string{
+		"Proxy Config Script": url,
+		"ProxyType":           "2",
+	}, nil
+}
+
+func (k kdeBackend) off() *linuxSettings {
+	return &linuxSettings{Values: map[string]string{"ProxyType": "0"}}
+}
+
+// envBackend - environment.d file of user session, applied to applications started after next login
+type envBackend struct {
+	path string
+}
+
+const envContentKey = "content"
+
+func envFilePath() string {
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		home, _ := os.UserHomeDir()
+		dir = filepath.Join(home, ".config")
+	}
+	return filepath.Join(dir, "environment.d", "tonutils-proxy.conf")
+}
+
+func (e envBackend) read() (*linuxSettings, error) {
+	data, err := os.ReadFile(e.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return &linuxSettings{Values: map[string]string{}, Missing: []string{envContentKey}}, nil
+		}
+		return nil, err
+	}
+	return &linuxSettings{Values: map[string]string{envContentKey: string(data)}}, nil
+}
+
+func (e envBackend) write(s *linuxSettings) error {
+	if v, ok := s.Values[envContentKey]; ok {
+		if err := os.MkdirAll(filepath.Dir(e.path), 0755); err != nil {
+			return err
+		}
+		return os.WriteFile(e.path, []byte(v), 0644)
+	}
+
+	if slices.Contains(s.Missing, envContentKey) {
+		if err := os.Remove(e.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e envBackend) proxy(host, port string) (map[string]string, error) {
+	u := "http://" + host + ":" + port
+	return map[string]string{
+		envContentKey: "# set by tonutils-proxy, applied after next login\n" +
+			"http_proxy=" + u + "\nHTTP_PROXY=" + u + "\n" +
+			"no_proxy=localhost,127.0.0.1,::1\nNO_PROXY=localhost,127.0.0.1,::1\n",
+	}, nil
+}
+
+func (e envBackend) pac(url string) (map[string]string, error) {
+	return nil, errors.New("proxy auto-config is not supported by environment variables, use global proxy instead")
 }
 
-func disableProxy() error {
-	return errors.New("automatic system configuration is not yet implemented for your platform")
+func (e envBackend) off() *linuxSettings {
+	return &linuxSettings{Missing: []string{envContentKey}}
 }
@@ -1,12 +1,197 @@
 package access
 
-import "strings"
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// SnapshotPath - file to keep original system proxy settings in while they are changed by us,
+// user config dir is used when empty
+var SnapshotPath = ""
+
+// snapshot - system proxy settings before we changed them, format of Settings depends on platform,
+// its existence means that current settings were set by us
+type snapshot struct {
+	OS string
+	// PID - process which changed settings last
+	PID      int
+	Settings json.RawMessage
+}
+
+// applied - settings set by this process last, PAC is set in pac mode, Host and Port otherwise
+type applied struct {
+	Host string
+	Port string
+	PAC  string
+}
+
+var mx sync.Mutex
+var lastApplied *applied
 
 func SetProxy(addr string) error {
 	s := strings.Split(addr, ":")
-	return enableProxy(s[0], s[1])
+	return change(&applied{Host: s[0], Port: s[1]}, func() error {
+		return enableProxy(s[0], s[1])
+	})
+}
+
+// SetPAC - configures system to use proxy auto-config file from url,
+// so only domains listed in it will go through proxy
+func SetPAC(url string) error {
+	return change(&applied{PAC: url}, func() error {
+		return enablePAC(url)
+	})
 }
 
+// ClearProxy - restores system proxy settings which were before SetProxy or SetPAC,
+// when snapshot is lost, settings set by this process are switched off, if they are still active
 func ClearProxy() error {
-	return disableProxy()
+	mx.Lock()
+	defer mx.Unlock()
+
+	restored, err := restore(anySnapshot)
+	if err != nil || restored || lastApplied == nil {
+		return err
+	}
+
+	if err = disableProxy(lastApplied); err != nil {
+		return fmt.Errorf("failed to disable system proxy: %w", err)
+	}
+	lastApplied = nil
+	return nil
+}
+
+// RestorePrevious - restores system proxy settings left changed by process which was not stopped properly,
+// should be called on startup, returns true when settings were restored
+func RestorePrevious() (bool, error) {
+	mx.Lock()
+	defer mx.Unlock()
+
+	return restore(func(s *snapshot) bool {
+		// settings of another running instance are not touched
+		return s.PID == os.Getpid() || !processAlive(s.PID)
+	})
+}
+
+func change(a *applied, apply func() error) error {
+	mx.Lock()
+	defer mx.Unlock()
+
+	path, err := snapshotPath()
+	if err != nil {
+		return err
+	}
+
+	s, err := readSnapshot(path)
+	if err != nil {
+		return err
+	}
+
+	if s == nil {
+		// save settings only before first change, next ones are ours
+		settings, err := saveSettings()
+		if err != nil {
+			return fmt.Errorf("failed to save current system proxy settings: %w", err)
+		}
+		s = &snapshot{OS: runtime.GOOS, Settings: settings}
+	}
+	s.PID = os.Getpid()
+
+	if err = writeSnapshot(path, s); err != nil {
+		return fmt.Errorf("failed to save current system proxy settings: %w", err)
+	}
+
+	if err = apply(); err != nil {
+		_, _ = restore(anySnapshot)
+		return err
+	}
+	lastApplied = a
+	return nil
+}
+
+func anySnapshot(*snapshot) bool {
+	return true
+}
+
+// restore - restores settings from snapshot when it exists and allowed by filter
+func restore(filter func(s *snapshot) bool) (bool, error) {
+	path, err := snapshotPath()
+	if err != nil {
+		return false, err
+	}
+
+	s, err := readSnapshot(path)
+	if err != nil {
+		return false, err
+	}
+
+	if s == nil || !filter(s) {
+		// nothing was changed by us, or changed by other process
+		return false, nil
+	}
+
+	if s.OS == runtime.GOOS {
+		if err = restoreSettings(s.Settings); err != nil {
+			return false, fmt.Errorf("failed to restore system proxy settings: %w", err)
+		}
+	}
+
+	if err = os.Remove(path); err != nil {
+		return false, fmt.Errorf("failed to remove system proxy settings snapshot: %w", err)
+	}
+	lastApplied = nil
+	return true, nil
+}
+
+func snapshotPath() (string, error) {
+	if SnapshotPath != "" {
+		return SnapshotPath, nil
+	}
+
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to get config dir: %w", err)
+	}
+	return filepath.Join(dir, "tonutils-proxy", "system-proxy.json"), nil
+}
+
+// readSnapshot - returns nil when there is no snapshot
+func readSnapshot(path string) (*snapshot, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read system proxy settings snapshot: %w", err)
+	}
+
+	var s snapshot
+	if err = json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("failed to parse system proxy settings snapshot: %w", err)
+	}
+	return &s, nil
+}
+
+// writeSnapshot - writes to temp file and renames it, to not leave broken snapshot on crash
+func writeSnapshot(path string, s *snapshot) error {
+	data, err := json.MarshalIndent(s, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err = os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
 }
@@ -0,0 +1,194 @@
+package access
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testEnv - makes system proxy settings go to environment file in temp dir, returns path of this file
+func testEnv(t *testing.T) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	t.Setenv("XDG_CURRENT_DESKTOP", "")
+	t.Setenv("DESKTOP_SESSION", "")
+	t.Setenv("XDG_CONFIG_HOME", dir)
+
+	prev := SnapshotPath
+	SnapshotPath = filepath.Join(dir, "tonutils-proxy", "system-proxy.json")
+	lastApplied = nil
+	t.Cleanup(func() {
+		SnapshotPath = prev
+		lastApplied = nil
+	})
+
+	return envFilePath()
+}
+
+// readEnv - returns content of environment file, or empty string with false when it does not exist
+func readEnv(t *testing.T, path string) (string, bool) {
+	t.Helper()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return "", false
+		}
+		t.Fatal(err)
+	}
+	return string(data), true
+}
+
+func writeEnv(t *testing.T, path, content string) {
+	t.Helper()
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func assertNoSnapshot(t *testing.T) {
+	t.Helper()
+
+	if _, err := os.Stat(SnapshotPath); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("snapshot is not removed: %v", err)
+	}
+}
+
+func TestSetAndClearProxy(t *testing.T) {
+	tests := []struct {
+		name string
+		// original - content of environment file before change, nil when there is no file
+		original *string
+		addrs    []string
+	}{
+		{name: "no original settings", addrs: []string{"127.0.0.1:8080"}},
+		{name: "original settings", original: ptr("http_proxy=http://10.0.0.1:3128\n"), addrs: []string{"127.0.0.1:8080"}},
+		{name: "empty original settings", original: ptr(""), addrs: []string{"127.0.0.1:8080"}},
+		// second change should keep snapshot of settings before first one
+		{name: "changed twice", original: ptr("http_proxy=http://10.0.0.1:3128\n"), addrs: []string{"127.0.0.1:8080", "127.0.0.1:9090"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := testEnv(t)
+			if tt.original != nil {
+				writeEnv(t, path, *tt.original)
+			}
+
+			for _, addr := range tt.addrs {
+				if err := SetProxy(addr); err != nil {
+					t.Fatal(err)
+				}
+
+				got, _ := readEnv(t, path)
+				if !strings.Contains(got, "http_proxy=http://"+addr+"\n") {
+					t.Fatalf("proxy %s is not set, got %q", addr, got)
+				}
+
+				s, err := readSnapshot(SnapshotPath)
+				if err != nil || s == nil {
+					t.Fatalf("no snapshot: %v", err)
+				}
+				if s.PID != os.Getpid() {
+					t.Fatalf("want snapshot of pid %d, got %d", os.Getpid(), s.PID)
+				}
+			}
+
+			if err := ClearProxy(); err != nil {
+				t.Fatal(err)
+			}
+
+			got, exists := readEnv(t, path)
+			if exists != (tt.original != nil) {
+				t.Fatalf("want file exists %v, got %v", tt.original != nil, exists)
+			}
+			if tt.original != nil && got != *tt.original {
+				t.Fatalf("want %q restored, got %q", *tt.original, got)
+			}
+			assertNoSnapshot(t)
+			if lastApplied != nil {
+				t.Fatal("applied settings are not forgotten")
+			}
+		})
+	}
+}
+
+func TestSetPACFailureRestores(t *testing.T) {
+	const original = "FOO=bar\n"
+
+	path := testEnv(t)
+	writeEnv(t, path, original)
+
+	if err := SetPAC("http://127.0.0.1:8080/proxy.pac"); err == nil {
+		t.Fatal("pac accepted by environment file")
+	}
+
+	if got, _ := readEnv(t, path); got != original {
+		t.Fatalf("want %q kept, got %q", original, got)
+	}
+	assertNoSnapshot(t)
+	if lastApplied != nil {
+		t.Fatal("failed settings are remembered as applied")
+	}
+}
+
+func TestClearProxyWithoutSnapshot(t *testing.T) {
+	tests := []struct {
+		name string
+		// changedTo - content written by someone else after our change, empty when not changed
+		changedTo string
+		wantFile  bool
+	}{
+		{name: "our settings are disabled", wantFile: false},
+		{name: "settings of someone else are kept", changedTo: "http_proxy=http://10.0.0.1:3128\n", wantFile: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := testEnv(t)
+
+			if err := SetProxy("127.0.0.1:8080"); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Remove(SnapshotPath); err != nil {
+				t.Fatal(err)
+			}
+			if tt.changedTo != "" {
+				writeEnv(t, path, tt.changedTo)
+			}
+
+			if err := ClearProxy(); err != nil {
+				t.Fatal(err)
+			}
+
+			got, exists := readEnv(t, path)
+			if exists != tt.wantFile {
+				t.Fatalf("want file exists %v, got %v", tt.wantFile, exists)
+			}
+			if tt.wantFile && got != tt.changedTo {
+				t.Fatalf("want %q kept, got %q", tt.changedTo, got)
+			}
+		})
+	}
+
+	// nothing was applied, nothing to disable
+	path := testEnv(t)
+	writeEnv(t, path, "FOO=bar\n")
+	if err := ClearProxy(); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := readEnv(t, path); got != "FOO=bar\n" {
+		t.Fatalf("settings changed without snapshot, got %q", got)
+	}
+}
+
+func ptr(s string) *string {
+	return &s
+}
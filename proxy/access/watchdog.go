@@ -0,0 +1,83 @@
+package access
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+)
+
+// WatchdogArg - first command line argument of executable started as watchdog
+const WatchdogArg = "--system-proxy-watchdog"
+
+// watchdogPipe - write end of pipe to watchdog, closed by os when process disappears
+var watchdogPipe *os.File
+var watchdogMx sync.Mutex
+
+// StartWatchdog - starts copy of current executable which restores system proxy settings
+// when this process disappears without clearing them, executable should call RunWatchdog first thing in main
+func StartWatchdog() error {
+	watchdogMx.Lock()
+	defer watchdogMx.Unlock()
+
+	if watchdogPipe != nil {
+		return nil
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to get executable path: %w", err)
+	}
+
+	path, err := snapshotPath()
+	if err != nil {
+		return err
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("failed to create pipe: %w", err)
+	}
+	defer r.Close()
+
+	cmd := exec.Command(exe, WatchdogArg, strconv.Itoa(os.Getpid()), path)
+	cmd.Stdin = r
+	detach(cmd)
+
+	if err = cmd.Start(); err != nil {
+		_ = w.Close()
+		return fmt.Errorf("failed to start watchdog: %w", err)
+	}
+	go cmd.Wait()
+
+	// kept open until exit, watchdog reads EOF when we are gone
+	watchdogPipe = w
+	return nil
+}
+
+// RunWatchdog - when executable was started as watchdog, waits for parent process to disappear,
+// restores system proxy settings if they were left changed by it and returns true
+func RunWatchdog(args []string) bool {
+	if len(args) < 3 || args[0] != WatchdogArg {
+		return false
+	}
+
+	pid, err := strconv.Atoi(args[1])
+	if err != nil {
+		return true
+	}
+	SnapshotPath = args[2]
+
+	// blocks until pipe is closed by parent exit
+	_, _ = io.Copy(io.Discard, os.Stdin)
+
+	mx.Lock()
+	defer mx.Unlock()
+
+	_, _ = restore(func(s *snapshot) bool {
+		return s.PID == pid
+	})
+	return true
+}
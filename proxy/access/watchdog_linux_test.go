@@ -0,0 +1,180 @@
+package access
+
+import (
+	"os"
+	"os/exec"
+	"testing"
+)
+
+func TestRunWatchdogArgs(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want bool
+	}{
+		{name: "no args", args: nil, want: false},
+		{name: "regular args", args: []string{"--config", "config.json", "--debug"}, want: false},
+		{name: "not enough args", args: []string{WatchdogArg, "123"}, want: false},
+		{name: "watchdog arg is not first", args: []string{"--debug", WatchdogArg, "123", "snapshot.json"}, want: false},
+		// started as watchdog, but nothing to watch, exits without waiting
+		{name: "invalid pid", args: []string{WatchdogArg, "abc", "snapshot.json"}, want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := RunWatchdog(tt.args); got != tt.want {
+				t.Fatalf("want %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestRunWatchdog(t *testing.T) {
+	tests := []struct {
+		name string
+		// snapshotPID - pid of process which changed settings last, watched one is 1000
+		snapshotPID int
+		want        bool
+	}{
+		{name: "watched process", snapshotPID: 1000, want: true},
+		// settings were taken over by another instance after watched one
+		{name: "other process", snapshotPID: 1001, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := testEnv(t)
+			closedStdin(t)
+
+			if err := SetProxy("127.0.0.1:8080"); err != nil {
+				t.Fatal(err)
+			}
+
+			setSnapshotPID(t, tt.snapshotPID)
+
+			if !RunWatchdog([]string{WatchdogArg, "1000", SnapshotPath}) {
+				t.Fatal("not started as watchdog")
+			}
+
+			_, exists := readEnv(t, path)
+			if exists == tt.want {
+				t.Fatalf("want settings restored %v, got file exists %v", tt.want, exists)
+			}
+			if _, err := os.Stat(SnapshotPath); (err == nil) == tt.want {
+				t.Fatalf("want snapshot removed %v, got %v", tt.want, err)
+			}
+		})
+	}
+}
+
+func TestProcessAlive(t *testing.T) {
+	tests := []struct {
+		name string
+		pid  func(t *testing.T) int
+		want bool
+	}{
+		{name: "zero", pid: func(*testing.T) int { return 0 }, want: false},
+		{name: "negative", pid: func(*testing.T) int { return -1 }, want: false},
+		{name: "own", pid: func(*testing.T) int { return os.Getpid() }, want: true},
+		{name: "init", pid: func(*testing.T) int { return 1 }, want: true},
+		{name: "finished", pid: deadPID, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := processAlive(tt.pid(t)); got != tt.want {
+				t.Fatalf("want %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestRestorePrevious(t *testing.T) {
+	tests := []struct {
+		name string
+		pid  func(t *testing.T) int
+		want bool
+	}{
+		{name: "own", pid: func(*testing.T) int { return os.Getpid() }, want: true},
+		{name: "dead process", pid: deadPID, want: true},
+		{name: "no process", pid: func(*testing.T) int { return 0 }, want: true},
+		// pid 1 is always alive, settings of running instance are not touched
+		{name: "running process", pid: func(*testing.T) int { return 1 }, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := testEnv(t)
+
+			if err := SetProxy("127.0.0.1:8080"); err != nil {
+				t.Fatal(err)
+			}
+			setSnapshotPID(t, tt.pid(t))
+
+			restored, err := RestorePrevious()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if restored != tt.want {
+				t.Fatalf("want restored %v, got %v", tt.want, restored)
+			}
+
+			_, exists := readEnv(t, path)
+			if exists == tt.want {
+				t.Fatalf("want settings restored %v, got file exists %v", tt.want, exists)
+			}
+			if _, err = os.Stat(SnapshotPath); (err == nil) == tt.want {
+				t.Fatalf("want snapshot removed %v, got %v", tt.want, err)
+			}
+		})
+	}
+
+	// nothing to restore
+	testEnv(t)
+	if restored, err := RestorePrevious(); err != nil || restored {
+		t.Fatalf("want nothing restored, got %v %v", restored, err)
+	}
+}
+
+// setSnapshotPID - pretends that current settings were changed by other process
+func setSnapshotPID(t *testing.T, pid int) {
+	t.Helper()
+
+	s, err := readSnapshot(SnapshotPath)
+	if err != nil || s == nil {
+		t.Fatalf("no snapshot: %v", err)
+	}
+	s.PID = pid
+	if err = writeSnapshot(SnapshotPath, s); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// deadPID - returns pid of already finished process
+func deadPID(t *testing.T) int {
+	t.Helper()
+
+	cmd := exec.Command("true")
+	if err := cmd.Run(); err != nil {
+		t.Skipf("cannot run process: %v", err)
+	}
+	return cmd.Process.Pid
+}
+
+// closedStdin - replaces stdin with pipe which is already closed by other side, like after parent exit
+func closedStdin(t *testing.T) {
+	t.Helper()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = w.Close()
+
+	prev := os.Stdin
+	os.Stdin = r
+	t.Cleanup(func() {
+		os.Stdin = prev
+		_ = r.Close()
+	})
+}
@@ -0,0 +1,23 @@
+//go:build !windows
+
+package access
+
+import (
+	"errors"
+	"os/exec"
+	"syscall"
+)
+
+// detach - moves process to own group, to not be killed together with parent by terminal signals
+func detach(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+func processAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
@@ -0,0 +1,39 @@
+//go:build windows
+
+package access
+
+import (
+	"golang.org/x/sys/windows"
+	"os/exec"
+	"syscall"
+)
+
+// _StillActive - exit code of process which is still running
+const _StillActive = 259
+
+// detach - starts process in own group, without console window
+func detach(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		CreationFlags: windows.CREATE_NEW_PROCESS_GROUP | windows.CREATE_NO_WINDOW,
+		HideWindow:    true,
+	}
+}
+
+func processAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+
+	h, err := windows.OpenProcess(windows.PROCESS_QUERY_LIMITED_INFORMATION, false, uint32(pid))
+	if err != nil {
+		// exists, but belongs to someone else
+		return err == windows.ERROR_ACCESS_DENIED
+	}
+	defer windows.CloseHandle(h)
+
+	var code uint32
+	if err = windows.GetExitCodeProcess(h, &code); err != nil {
+		return false
+	}
+	return code == _StillActive
+}
@@ -3,100 +3,178 @@
 package access
 
 import (
+	"encoding/json"
 	"errors"
-	"unsafe"
+	"fmt"
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/registry"
 )
 
-/*
-#include <Windows.h>
-#include <string.h>
+func enableProxy(addr, port string) error {
+	k, err := registry.OpenKey(registry.CURRENT_USER, internetSettingsKey, registry.SET_VALUE)
+	if err != nil {
+		return fmt.Errorf("can't set proxy, err: missing key: %w", err)
+	}
+	defer k.Close()
 
-enum RET_ERRORS {
-	RET_NO_ERROR = 0,
-	MISSING_KEY = 1,
-	SET_ENABLE_PROXY_ERROR = 2,
-	SET_HOSTANDPORT_PROXY_ERROR = 3,
-	SET_EXCEPTION_PROXY_ERROR = 4
-};
+	if err = k.SetDWordValue("ProxyEnable", 1); err != nil {
+		return fmt.Errorf("can't set proxy, err: failed enable proxy: %w", err)
+	}
+	if err = k.SetStringValue("ProxyServer", addr+":"+port); err != nil {
+		return fmt.Errorf("can't set proxy, err: failed set host and port: %w", err)
+	}
+	if err = k.SetStringValue("ProxyOverride", "https://*"); err != nil {
+		return fmt.Errorf("can't set proxy, err: failed set exception for proxy: %w", err)
+	}
 
-HKEY hKey;
+	// pac file set before has priority over proxy server, original value is kept in snapshot
+	if err = deleteValue(k, "AutoConfigURL"); err != nil {
+		return fmt.Errorf("can't set proxy, err: failed remove auto config url: %w", err)
+	}
+	return refreshSettings()
+}
 
-int setPoxy(char* host, char* proxyException) {
-	DWORD proxyEnable = 0x00000001;
+func enablePAC(url string) error {
+	k, err := registry.OpenKey(registry.CURRENT_USER, internetSettingsKey, registry.SET_VALUE)
+	if err != nil {
+		return fmt.Errorf("can't set pac, err: missing key: %w", err)
+	}
+	defer k.Close()
 
-	if (RegOpenKeyEx(HKEY_CURRENT_USER, TEXT("SOFTWARE\\Microsoft\\Windows\\CurrentVersion\\Internet Settings"), 0, KEY_ALL_ACCESS, &hKey) != ERROR_SUCCESS)
-	{
-		return MISSING_KEY;
+	if err = k.SetDWordValue("ProxyEnable", 0); err != nil {
+		return fmt.Errorf("can't set pac, err: failed disable proxy: %w", err)
+	}
+	if err = k.SetStringValue("AutoConfigURL", url); err != nil {
+		return fmt.Errorf("can't set pac, err: failed set auto config url: %w", err)
 	}
 
-	if (RegSetValueEx(hKey, TEXT("ProxyEnable"), 0, REG_DWORD, (const BYTE*)&proxyEnable, sizeof(proxyEnable)) != ERROR_SUCCESS)
-	{
-		return SET_ENABLE_PROXY_ERROR;
+	// proxy server set before is not used anymore, original value is kept in snapshot
+	if err = deleteValue(k, "ProxyServer"); err != nil {
+		return fmt.Errorf("can't set pac, err: failed remove proxy server: %w", err)
 	}
+	return refreshSettings()
+}
 
-	if (RegSetValueEx(hKey, TEXT("ProxyServer"), 0, REG_SZ, host, strlen(host)) != ERROR_SUCCESS)
-	{
-		return SET_HOSTANDPORT_PROXY_ERROR;
+// disableProxy - switches off proxy server or pac url, only when they are still the ones we set
+func disableProxy(a *applied) error {
+	k, err := registry.OpenKey(registry.CURRENT_USER, internetSettingsKey, registry.QUERY_VALUE|registry.SET_VALUE)
+	if err != nil {
+		return err
+	}
+	defer k.Close()
+
+	if a.PAC != "" {
+		if v, _, err := k.GetStringValue("AutoConfigURL"); err != nil || v != a.PAC {
+			return nil
+		}
+		err = deleteValue(k, "AutoConfigURL")
+	} else {
+		if v, _, err := k.GetStringValue("ProxyServer"); err != nil || v != a.Host+":"+a.Port {
+			return nil
+		}
+		err = k.SetDWordValue("ProxyEnable", 0)
+	}
+	if err != nil {
+		return err
 	}
+	return refreshSettings()
+}
+
+const (
+	_InternetOptionRefresh         = 37
+	_InternetOptionSettingsChanged = 39
+)
 
-	if (RegSetValueEx(hKey, TEXT("ProxyOverride"), 0, REG_SZ, proxyException, strlen(proxyException)) != ERROR_SUCCESS)
-	{
-		return SET_EXCEPTION_PROXY_ERROR;
+var procInternetSetOption = windows.NewLazySystemDLL("wininet.dll").NewProc("InternetSetOptionW")
+
+// refreshSettings - notifies running applications that internet settings in registry were changed,
+// without it browsers keep using old proxy until restart
+func refreshSettings() error {
+	for _, opt := range []uintptr{_InternetOptionSettingsChanged, _InternetOptionRefresh} {
+		if r, _, err := procInternetSetOption.Call(0, opt, 0, 0); r == 0 {
+			return fmt.Errorf("failed to notify about changed internet settings: %w", err)
+		}
 	}
+	return nil
+}
+
+const internetSettingsKey = `SOFTWARE\Microsoft\Windows\CurrentVersion\Internet Settings`
 
-		RegCloseKey(hKey);
+// windowsSettings - values of internet settings which we change
+type windowsSettings struct {
+	ProxyEnable *uint32
+	// Values - string values, not set ones are absent
+	Values map[string]string
 }
 
-int disPoxy() {
-	DWORD proxyDisable = 0x00000000;
+var windowsStringValues = []string{"ProxyServer", "ProxyOverride", "AutoConfigURL"}
 
-	if (RegOpenKeyEx(HKEY_CURRENT_USER, TEXT("SOFTWARE\\Microsoft\\Windows\\CurrentVersion\\Internet Settings"), 0, KEY_ALL_ACCESS, &hKey) != ERROR_SUCCESS)
-	{
-		return MISSING_KEY;
+func saveSettings() ([]byte, error) {
+	k, err := registry.OpenKey(registry.CURRENT_USER, internetSettingsKey, registry.QUERY_VALUE)
+	if err != nil {
+		return nil, err
 	}
-
-	if (RegSetValueEx(hKey, TEXT("ProxyEnable"), 0, REG_DWORD, (const BYTE*)&proxyDisable, sizeof(proxyDisable)) != ERROR_SUCCESS)
-	{
-		return SET_ENABLE_PROXY_ERROR;
+	defer k.Close()
+
+	s := windowsSettings{Values: map[string]string{}}
+	if v, _, err := k.GetIntegerValue("ProxyEnable"); err == nil {
+		enable := uint32(v)
+		s.ProxyEnable = &enable
+	} else if !errors.Is(err, registry.ErrNotExist) {
+		return nil, err
 	}
 
-		RegCloseKey(hKey);
+	for _, name := range windowsStringValues {
+		v, _, err := k.GetStringValue(name)
+		if err != nil {
+			if errors.Is(err, registry.ErrNotExist) {
+				continue
+			}
+			return nil, err
+		}
+		s.Values[name] = v
+	}
+	return json.Marshal(&s)
 }
-*/
-import "C"
 
-func enableProxy(addr, port string) error {
-	host := addr + ":" + port
-	cHost := C.CString(host)
-	defer C.free(unsafe.Pointer(cHost))
-
-	proxyException := "https://*"
-	cProxyException := C.CString(proxyException)
-	defer C.free(unsafe.Pointer(cProxyException))
-
-	res := C.setPoxy(cHost, cProxyException)
-	resGo := int(res)
-	switch resGo {
-	case 1:
-		return errors.New("can't set proxy, err: missing key")
-	case 2:
-		return errors.New("can't set proxy, err: failed enable proxy")
-	case 3:
-		return errors.New("can't set proxy, err: failed set host and port")
-	case 4:
-		return errors.New("can't set proxy, err: failed set exception for proxy")
+func restoreSettings(data []byte) error {
+	var s windowsSettings
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
 	}
-	return nil
+
+	k, err := registry.OpenKey(registry.CURRENT_USER, internetSettingsKey, registry.SET_VALUE)
+	if err != nil {
+		return err
+	}
+	defer k.Close()
+
+	for _, name := range windowsStringValues {
+		if v, ok := s.Values[name]; ok {
+			err = k.SetStringValue(name, v)
+		} else {
+			err = deleteValue(k, name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// enable flag goes last, to switch it when everything else is restored
+	if s.ProxyEnable != nil {
+		err = k.SetDWordValue("ProxyEnable", *s.ProxyEnable)
+	} else {
+		err = deleteValue(k, "ProxyEnable")
+	}
+	if err != nil {
+		return err
+	}
+	return refreshSettings()
 }
 
-func disableProxy() error {
-	res := C.disPoxy()
-	resGo := int(res)
-	switch resGo {
-	case 1:
-		return errors.New("can't set proxy, err: missing key")
-	case 2:
-		return errors.New("can't set proxy, err: failed enable proxy")
+func deleteValue(k registry.Key, name string) error {
+	if err := k.DeleteValue(name); err != nil && !errors.Is(err, registry.ErrNotExist) {
+		return err
 	}
 	return nil
 }
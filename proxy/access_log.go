@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"github.com/xssnick/tonutils-proxy/proxy/accesslog"
+	"net"
+	"net/http"
+	"time"
+)
+
+type accessRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (r *accessRecorder) WriteHeader(code int) {
+	if r.status == 0 {
+		r.status = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *accessRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	return n, err
+}
+
+// Flush - forwards flush to underlying writer, to not break streaming responses
+func (r *accessRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap - lets http.ResponseController reach underlying writer
+func (r *accessRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+func (p *proxy) logAccess(req *http.Request, rec *accessRecorder, rule *RoutingRule, user, path string, start time.Time) {
+	client := req.RemoteAddr
+	if ip, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		client = ip
+	}
+
+	route := accesslog.RouteWeb2
+	switch rule.Action {
+	case RouteStorage:
+		route = accesslog.RouteStorage
+	case RouteRLDP:
+		route = accesslog.RouteRLDP
+	}
+
+	if rule.isTON() {
+		// dns record of site could point to storage bag as well
+		if r := p.transport.SiteRoute(req.Host); r != "" {
+			route = r
+		}
+	}
+
+	status := rec.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	p.accessLog.Log(&accesslog.Entry{
+		Time:     start,
+		Client:   client,
+		User:     user,
+		Method:   req.Method,
+		Host:     req.Host,
+		Path:     path,
+		Proto:    req.Proto,
+		Status:   status,
+		Bytes:    rec.bytes,
+		Duration: time.Since(start),
+		Route:    route,
+		Tunnel:   p.viaTunnel(rule),
+	})
+}
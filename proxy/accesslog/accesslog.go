@@ -0,0 +1,131 @@
+package accesslog
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	FormatJSON = "json"
+	FormatCLF  = "clf"
+)
+
+const (
+	RouteRLDP    = "rldp"
+	RouteStorage = "storage"
+	RouteWeb2    = "web2"
+)
+
+type Config struct {
+	// Path - file to write log to, stdout is used when empty
+	Path string
+	// Format - json (default) or clf
+	Format string
+	// MaxSizeMB - file is rotated when it grows over this size, 0 disables rotation
+	MaxSizeMB int
+	// MaxBackups - number of rotated files to keep
+	MaxBackups int
+}
+
+type Entry struct {
+	Time     time.Time     `json:"time"`
+	Client   string        `json:"client"`
+	User     string        `json:"user,omitempty"`
+	Method   string        `json:"method"`
+	Host     string        `json:"host"`
+	Path     string        `json:"path"`
+	Proto    string        `json:"proto"`
+	Status   int           `json:"status"`
+	Bytes    int64         `json:"bytes"`
+	Duration time.Duration `json:"-"`
+	Route    string        `json:"route"`
+	Tunnel   bool          `json:"tunnel"`
+}
+
+type Logger struct {
+	format string
+	out    io.Writer
+	closer io.Closer
+	mx     sync.Mutex
+}
+
+func New(cfg Config) (*Logger, error) {
+	l := &Logger{format: cfg.Format}
+	switch l.format {
+	case "":
+		l.format = FormatJSON
+	case FormatJSON, FormatCLF:
+	default:
+		return nil, fmt.Errorf("unknown access log format %q", cfg.Format)
+	}
+
+	if cfg.Path == "" {
+		l.out = os.Stdout
+		return l, nil
+	}
+
+	f, err := openRotatingFile(cfg.Path, int64(cfg.MaxSizeMB)*1024*1024, cfg.MaxBackups)
+	if err != nil {
+		return nil, err
+	}
+	l.out = f
+	l.closer = f
+	return l, nil
+}
+
+// Log - writes entry as a single line, errors are ignored to not affect proxied request
+func (l *Logger) Log(e *Entry) {
+	var line []byte
+	if l.format == FormatCLF {
+		line = formatCLF(e)
+	} else {
+		line = formatJSON(e)
+	}
+
+	l.mx.Lock()
+	_, _ = l.out.Write(line)
+	l.mx.Unlock()
+}
+
+func (l *Logger) Close() error {
+	if l.closer == nil {
+		return nil
+	}
+	return l.closer.Close()
+}
+
+func formatJSON(e *Entry) []byte {
+	data, _ := json.Marshal(struct {
+		*Entry
+		DurationMS float64 `json:"duration_ms"`
+	}{e, float64(e.Duration.Microseconds()) / 1000})
+	return append(data, '\n')
+}
+
+// formatCLF - common log format, with host, route, duration in ms and tunnel usage appended
+func formatCLF(e *Entry) []byte {
+	user := e.User
+	if user == "" {
+		user = "-"
+	}
+
+	bytes := "-"
+	if e.Bytes > 0 {
+		bytes = strconv.FormatInt(e.Bytes, 10)
+	}
+
+	tunnel := "-"
+	if e.Tunnel {
+		tunnel = "tunnel"
+	}
+
+	return []byte(fmt.Sprintf("%s - %s [%s] \"%s %s %s\" %d %s %s %s %d %s\n",
+		e.Client, user, e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		e.Method, e.Path, e.Proto, e.Status, bytes, e.Host,
+		e.Route, e.Duration.Milliseconds(), tunnel))
+}
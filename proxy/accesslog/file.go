@@ -0,0 +1,136 @@
+package accesslog
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// when rotation fails, writing continues to the current file and rotation is retried after this time
+const _RotateRetryInterval = time.Minute
+
+// rotatingFile - appends to file and moves it to path.1, path.2 ... when it grows over maxSize
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	file   *os.File
+	size   int64
+	closed bool
+	// rotateAfter - time of the next rotation attempt, after failed one
+	rotateAfter time.Time
+	mx          sync.Mutex
+}
+
+func openRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	f := &rotatingFile{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open access log file: %w", err)
+	}
+
+	st, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return fmt.Errorf("failed to stat access log file: %w", err)
+	}
+
+	f.file = file
+	f.size = st.Size()
+	return nil
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+
+	if f.file != nil && f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize && !time.Now().Before(f.rotateAfter) {
+		if err := f.rotate(); err != nil {
+			f.rotateAfter = time.Now().Add(_RotateRetryInterval)
+			if f.file == nil {
+				return 0, err
+			}
+			// continue to write to not rotated file
+		}
+	}
+
+	if f.file == nil {
+		// previous reopen failed, try again
+		if err := f.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// rotate - must be called under lock. File at path is reopened even when moving it has failed,
+// so logging continues to the original file.
+func (f *rotatingFile) rotate() error {
+	// handle is not usable after failed close too, so rotation goes on and file is reopened anyway
+	cErr := f.file.Close()
+	f.file = nil
+
+	err := f.shift()
+	if oErr := f.open(); oErr != nil {
+		return oErr
+	}
+	if cErr != nil {
+		return fmt.Errorf("failed to close access log file: %w", cErr)
+	}
+	return err
+}
+
+// shift - moves current file to path.1 and older backups further, or removes it when backups are disabled
+func (f *rotatingFile) shift() error {
+	if f.maxBackups <= 0 {
+		if err := os.Remove(f.path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove access log file: %w", err)
+		}
+		return nil
+	}
+
+	_ = os.Remove(fmt.Sprintf("%s.%d", f.path, f.maxBackups))
+	for i := f.maxBackups - 1; i > 0; i-- {
+		_ = os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1))
+	}
+
+	if err := os.Rename(f.path, f.path+".1"); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to rotate access log file: %w", err)
+	}
+	return nil
+}
+
+func (f *rotatingFile) Close() error {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+
+	f.closed = true
+	if f.file == nil {
+		return nil
+	}
+
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
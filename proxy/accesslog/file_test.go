@@ -0,0 +1,172 @@
+package accesslog
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestRotatingFile(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxSize    int64
+		maxBackups int
+		writes     []string
+		// want - expected content of log file and its backups, in order
+		want []string
+	}{
+		{
+			name:   "rotation disabled",
+			writes: []string{"aaaa\n", "bbbb\n", "cccc\n"},
+			want:   []string{"aaaa\nbbbb\ncccc\n"},
+		},
+		{
+			name:       "under limit",
+			maxSize:    20,
+			maxBackups: 2,
+			writes:     []string{"aaaa\n", "bbbb\n"},
+			want:       []string{"aaaa\nbbbb\n"},
+		},
+		{
+			name:       "rotated",
+			maxSize:    10,
+			maxBackups: 2,
+			writes:     []string{"aaaa\n", "bbbb\n", "cccc\n"},
+			want:       []string{"cccc\n", "aaaa\nbbbb\n"},
+		},
+		{
+			name:       "oldest backups removed",
+			maxSize:    5,
+			maxBackups: 2,
+			writes:     []string{"aaaa\n", "bbbb\n", "cccc\n", "dddd\n"},
+			want:       []string{"dddd\n", "cccc\n", "bbbb\n"},
+		},
+		{
+			name:    "no backups",
+			maxSize: 5,
+			writes:  []string{"aaaa\n", "bbbb\n"},
+			want:    []string{"bbbb\n"},
+		},
+		{
+			name:       "line bigger than limit",
+			maxSize:    5,
+			maxBackups: 1,
+			writes:     []string{"aaaaaaaa\n", "bbbbbbbb\n"},
+			want:       []string{"bbbbbbbb\n", "aaaaaaaa\n"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "access.log")
+			f, err := openRotatingFile(path, tt.maxSize, tt.maxBackups)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, w := range tt.writes {
+				if _, err = f.Write([]byte(w)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err = f.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			for i, want := range tt.want {
+				p := path
+				if i > 0 {
+					p = path + "." + strconv.Itoa(i)
+				}
+				if got := readFile(t, p); got != want {
+					t.Fatalf("want %q in %s, got %q", want, filepath.Base(p), got)
+				}
+			}
+
+			if _, err = os.Stat(path + "." + strconv.Itoa(len(tt.want))); !os.IsNotExist(err) {
+				t.Fatalf("unexpected backup %d", len(tt.want))
+			}
+		})
+	}
+}
+
+func TestRotatingFileKeepsLoggingWhenRotationFails(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+
+	// backup path is a directory with a file, so current log cannot be moved there
+	if err := os.MkdirAll(filepath.Join(path+".1", "busy"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := openRotatingFile(path, 5, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	for _, w := range []string{"aaaa\n", "bbbb\n", "cccc\n"} {
+		if _, err = f.Write([]byte(w)); err != nil {
+			t.Fatalf("write failed after failed rotation: %v", err)
+		}
+	}
+
+	if got := readFile(t, path); got != "aaaa\nbbbb\ncccc\n" {
+		t.Fatalf("want all lines in current file, got %q", got)
+	}
+	if f.rotateAfter.IsZero() {
+		t.Fatal("next rotation attempt is not delayed")
+	}
+}
+
+func TestRotatingFileRotatesWhenCloseFails(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+
+	f, err := openRotatingFile(path, 5, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if _, err = f.Write([]byte("aaaa\n")); err != nil {
+		t.Fatal(err)
+	}
+	// handle is already closed, so closing it on rotation fails
+	_ = f.file.Close()
+
+	if _, err = f.Write([]byte("bbbb\n")); err != nil {
+		t.Fatalf("write failed after failed close: %v", err)
+	}
+	if _, err = f.Write([]byte("cccc\n")); err != nil {
+		t.Fatalf("write failed after failed close: %v", err)
+	}
+
+	if got := readFile(t, path); got != "bbbb\ncccc\n" {
+		t.Fatalf("want new lines in reopened file, got %q", got)
+	}
+	if got := readFile(t, path+".1"); got != "aaaa\n" {
+		t.Fatalf("want old lines in backup, got %q", got)
+	}
+}
+
+func TestRotatingFileClosed(t *testing.T) {
+	f, err := openRotatingFile(filepath.Join(t.TempDir(), "access.log"), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = f.Close()
+
+	if _, err = f.Write([]byte("line\n")); err != os.ErrClosed {
+		t.Fatalf("want closed error, got %v", err)
+	}
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
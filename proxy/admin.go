@@ -0,0 +1,136 @@
+package proxy
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"strings"
+)
+
+type adminHostRequest struct {
+	Host string `json:"host"`
+}
+
+type adminBlockHttpRequest struct {
+	Enabled bool `json:"enabled"`
+}
+
+type adminLogLevelRequest struct {
+	Level string `json:"level"`
+}
+
+type adminResponse struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+	Value any    `json:"value,omitempty"`
+}
+
+// SetLogLevel - changes global log level, one of: trace, debug, info, warn, error, disabled.
+// It is safe to call while other goroutines are logging, so level of log.Logger itself should not be limited.
+func SetLogLevel(level string) (zerolog.Level, error) {
+	lvl, err := zerolog.ParseLevel(level)
+	if err != nil || level == "" {
+		return zerolog.NoLevel, fmt.Errorf("invalid log level %q", level)
+	}
+
+	zerolog.SetGlobalLevel(lvl)
+	return lvl, nil
+}
+
+func writeAdminResponse(wr http.ResponseWriter, code int, resp adminResponse) {
+	wr.Header().Set("Content-Type", "application/json")
+	wr.WriteHeader(code)
+	_ = json.NewEncoder(wr).Encode(resp)
+}
+
+func writeAdminError(wr http.ResponseWriter, code int, err error) {
+	writeAdminResponse(wr, code, adminResponse{Error: err.Error()})
+}
+
+func (p *proxy) serveAdminAPI(wr http.ResponseWriter, req *http.Request) {
+	if p.adminToken == "" {
+		writeAdminError(wr, http.StatusNotFound, fmt.Errorf("admin api is disabled"))
+		return
+	}
+
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(p.adminToken)) != 1 {
+		writeAdminError(wr, http.StatusUnauthorized, fmt.Errorf("invalid token"))
+		return
+	}
+
+	if req.URL.Path == "/api/status" {
+		if req.Method != http.MethodGet {
+			writeAdminError(wr, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"))
+			return
+		}
+		writeAdminResponse(wr, http.StatusOK, adminResponse{OK: true, Value: p.getStatus()})
+		return
+	}
+
+	if req.Method != http.MethodPost {
+		writeAdminError(wr, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"))
+		return
+	}
+
+	switch req.URL.Path {
+	case "/api/cache/flush":
+		num := p.transport.FlushResolved()
+		log.Info().Int("sites", num).Msg("resolve cache flushed using admin api")
+		writeAdminResponse(wr, http.StatusOK, adminResponse{OK: true, Value: num})
+	case "/api/sites/drop":
+		var r adminHostRequest
+		if err := json.NewDecoder(req.Body).Decode(&r); err != nil || r.Host == "" {
+			writeAdminError(wr, http.StatusBadRequest, fmt.Errorf("host is required"))
+			return
+		}
+
+		if !p.transport.DropSite(r.Host) {
+			writeAdminError(wr, http.StatusNotFound, fmt.Errorf("site %s is not active", r.Host))
+			return
+		}
+		writeAdminResponse(wr, http.StatusOK, adminResponse{OK: true})
+	case "/api/bags/stop":
+		var r adminHostRequest
+		if err := json.NewDecoder(req.Body).Decode(&r); err != nil || r.Host == "" {
+			writeAdminError(wr, http.StatusBadRequest, fmt.Errorf("host or bag id is required"))
+			return
+		}
+
+		if !p.transport.StopBag(r.Host) {
+			writeAdminError(wr, http.StatusNotFound, fmt.Errorf("bag %s is not active", r.Host))
+			return
+		}
+		writeAdminResponse(wr, http.StatusOK, adminResponse{OK: true})
+	case "/api/block-http":
+		var r adminBlockHttpRequest
+		if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+			writeAdminError(wr, http.StatusBadRequest, fmt.Errorf("failed to parse request: %w", err))
+			return
+		}
+
+		p.blockHttp.Store(r.Enabled)
+		log.Info().Bool("enabled", r.Enabled).Msg("ordinary http blocking changed using admin api")
+		writeAdminResponse(wr, http.StatusOK, adminResponse{OK: true, Value: r.Enabled})
+	case "/api/log-level":
+		var r adminLogLevelRequest
+		if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+			writeAdminError(wr, http.StatusBadRequest, fmt.Errorf("failed to parse request: %w", err))
+			return
+		}
+
+		lvl, err := SetLogLevel(r.Level)
+		if err != nil {
+			writeAdminError(wr, http.StatusBadRequest, err)
+			return
+		}
+
+		log.Info().Str("level", lvl.String()).Msg("log level changed using admin api")
+		writeAdminResponse(wr, http.StatusOK, adminResponse{OK: true, Value: lvl.String()})
+	default:
+		writeAdminError(wr, http.StatusNotFound, fmt.Errorf("unknown method"))
+	}
+}
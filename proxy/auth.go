@@ -0,0 +1,172 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"golang.org/x/crypto/bcrypt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+type AuthUser struct {
+	Name string
+	// PasswordHash - bcrypt hash of the password, could be generated with cli flag -hash-password
+	PasswordHash string
+}
+
+type AuthConfig struct {
+	// Users - when not empty, Proxy-Authorization with Basic credentials of one of them is required
+	Users []AuthUser
+	// AllowIPs - when not empty, only clients from these ips or cidr subnets are served
+	AllowIPs []string
+	// AllowPublicWithoutAuth - allows to listen on non-loopback address without users configured,
+	// anyone who can reach the port will be able to use the proxy and paid tunnel
+	AllowPublicWithoutAuth bool
+}
+
+type authenticator struct {
+	users   map[string][]byte
+	allowed []*net.IPNet
+
+	// verified - sha256 of successfully checked credentials, to not run bcrypt for each request
+	verified sync.Map
+}
+
+func newAuthenticator(cfg AuthConfig, addr string) (*authenticator, error) {
+	a := &authenticator{
+		users: map[string][]byte{},
+	}
+
+	for _, u := range cfg.Users {
+		if u.Name == "" || u.PasswordHash == "" {
+			return nil, fmt.Errorf("user name and password hash should be set")
+		}
+
+		if _, err := bcrypt.Cost([]byte(u.PasswordHash)); err != nil {
+			return nil, fmt.Errorf("invalid password hash of user %s: %w", u.Name, err)
+		}
+		a.users[u.Name] = []byte(u.PasswordHash)
+	}
+
+	for _, s := range cfg.AllowIPs {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid allowed ip %s", s)
+			}
+
+			if ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+
+		_, subnet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allowed subnet %s: %w", s, err)
+		}
+		a.allowed = append(a.allowed, subnet)
+	}
+
+	// empty addr means proxy is not listening at all
+	if addr != "" && len(a.users) == 0 && !cfg.AllowPublicWithoutAuth && !isLoopbackAddr(addr) {
+		return nil, fmt.Errorf("refusing to listen on %s without authentication, configure users or explicitly allow public access", addr)
+	}
+	return a, nil
+}
+
+func isLoopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+
+	if host == "localhost" {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// authorize - checks client ip and credentials, writes error response and returns false when access is denied
+func (a *authenticator) authorize(wr http.ResponseWriter, req *http.Request) (user string, ok bool) {
+	if len(a.allowed) > 0 {
+		host, _, err := net.SplitHostPort(req.RemoteAddr)
+		if err != nil {
+			host = req.RemoteAddr
+		}
+
+		ip := net.ParseIP(host)
+		allowed := false
+		for _, subnet := range a.allowed {
+			if ip != nil && subnet.Contains(ip) {
+				allowed = true
+				break
+			}
+		}
+
+		if !allowed {
+			http.Error(wr, "Access denied", http.StatusForbidden)
+			return "", false
+		}
+	}
+
+	if len(a.users) == 0 {
+		return "", true
+	}
+
+	user, ok = a.checkCredentials(req.Header.Get("Proxy-Authorization"))
+	if !ok {
+		wr.Header().Set("Proxy-Authenticate", `Basic realm="Tonutils Proxy"`)
+		http.Error(wr, "Proxy authentication required", http.StatusProxyAuthRequired)
+		return "", false
+	}
+	return user, true
+}
+
+func (a *authenticator) checkCredentials(header string) (string, bool) {
+	const prefix = "Basic "
+	if len(header) < len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return "", false
+	}
+
+	data, err := base64.StdEncoding.DecodeString(header[len(prefix):])
+	if err != nil {
+		return "", false
+	}
+
+	name, password, found := strings.Cut(string(data), ":")
+	if !found {
+		return "", false
+	}
+
+	hash, exists := a.users[name]
+	if !exists {
+		return "", false
+	}
+
+	key := sha256.Sum256(append(append([]byte{}, hash...), data...))
+	if _, ok := a.verified.Load(key); ok {
+		return name, true
+	}
+
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		return "", false
+	}
+	a.verified.Store(key, struct{}{})
+	return name, true
+}
+
+// HashPassword - returns bcrypt hash of password to use in AuthUser
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
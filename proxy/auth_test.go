@@ -0,0 +1,170 @@
+package proxy
+
+import (
+	"encoding/base64"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func testPasswordHash(t *testing.T, password string) string {
+	t.Helper()
+
+	// min cost to keep tests fast, real hashes are made with HashPassword
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(hash)
+}
+
+func basicAuth(name, password string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(name+":"+password))
+}
+
+func TestIsLoopbackAddr(t *testing.T) {
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{addr: "127.0.0.1:8080", want: true},
+		{addr: "127.0.0.5:8080", want: true},
+		{addr: "[::1]:8080", want: true},
+		{addr: "localhost:8080", want: true},
+		{addr: "0.0.0.0:8080", want: false},
+		{addr: ":8080", want: false},
+		{addr: "[::]:8080", want: false},
+		{addr: "192.168.1.10:8080", want: false},
+		{addr: "example.com:8080", want: false},
+		{addr: "127.0.0.1", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			if got := isLoopbackAddr(tt.addr); got != tt.want {
+				t.Fatalf("want %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestNewAuthenticator(t *testing.T) {
+	user := AuthUser{Name: "alice", PasswordHash: testPasswordHash(t, "secret")}
+
+	tests := []struct {
+		name    string
+		cfg     AuthConfig
+		addr    string
+		wantErr bool
+	}{
+		{name: "loopback without users", addr: "127.0.0.1:8080"},
+		{name: "not listening", addr: ""},
+		{name: "public without users", addr: "0.0.0.0:8080", wantErr: true},
+		{name: "public only with allowed ips", cfg: AuthConfig{AllowIPs: []string{"192.168.1.0/24"}}, addr: "0.0.0.0:8080", wantErr: true},
+		{name: "public explicitly allowed", cfg: AuthConfig{AllowPublicWithoutAuth: true}, addr: "0.0.0.0:8080"},
+		{name: "public with users", cfg: AuthConfig{Users: []AuthUser{user}}, addr: "0.0.0.0:8080"},
+		{name: "plain password instead of hash", cfg: AuthConfig{Users: []AuthUser{{Name: "bob", PasswordHash: "secret"}}}, addr: "127.0.0.1:8080", wantErr: true},
+		{name: "user without name", cfg: AuthConfig{Users: []AuthUser{{PasswordHash: user.PasswordHash}}}, addr: "127.0.0.1:8080", wantErr: true},
+		{name: "allowed ip and subnets", cfg: AuthConfig{AllowIPs: []string{"10.0.0.1", "192.168.0.0/16", "::1", "fd00::/8"}}, addr: "127.0.0.1:8080"},
+		{name: "invalid allowed ip", cfg: AuthConfig{AllowIPs: []string{"10.0.0"}}, addr: "127.0.0.1:8080", wantErr: true},
+		{name: "invalid allowed subnet", cfg: AuthConfig{AllowIPs: []string{"10.0.0.0/33"}}, addr: "127.0.0.1:8080", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newAuthenticator(tt.cfg, tt.addr)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("want error %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	users := []AuthUser{{Name: "alice", PasswordHash: testPasswordHash(t, "secret")}}
+
+	tests := []struct {
+		name       string
+		cfg        AuthConfig
+		remoteAddr string
+		header     string
+		wantUser   string
+		wantCode   int
+	}{
+		{name: "no restrictions", remoteAddr: "10.0.0.1:5000", wantCode: http.StatusOK},
+		{name: "allowed ip", cfg: AuthConfig{AllowIPs: []string{"10.0.0.1"}}, remoteAddr: "10.0.0.1:5000", wantCode: http.StatusOK},
+		{name: "allowed subnet", cfg: AuthConfig{AllowIPs: []string{"10.0.0.0/8"}}, remoteAddr: "10.1.2.3:5000", wantCode: http.StatusOK},
+		{name: "not allowed ip", cfg: AuthConfig{AllowIPs: []string{"10.0.0.0/8"}}, remoteAddr: "192.168.1.1:5000", wantCode: http.StatusForbidden},
+		{name: "valid credentials", cfg: AuthConfig{Users: users}, remoteAddr: "10.0.0.1:5000", header: basicAuth("alice", "secret"), wantUser: "alice", wantCode: http.StatusOK},
+		{name: "lowercase scheme", cfg: AuthConfig{Users: users}, remoteAddr: "10.0.0.1:5000", header: "basic " + basicAuth("alice", "secret")[6:], wantUser: "alice", wantCode: http.StatusOK},
+		{name: "wrong password", cfg: AuthConfig{Users: users}, remoteAddr: "10.0.0.1:5000", header: basicAuth("alice", "wrong"), wantCode: http.StatusProxyAuthRequired},
+		{name: "unknown user", cfg: AuthConfig{Users: users}, remoteAddr: "10.0.0.1:5000", header: basicAuth("bob", "secret"), wantCode: http.StatusProxyAuthRequired},
+		{name: "no credentials", cfg: AuthConfig{Users: users}, remoteAddr: "10.0.0.1:5000", wantCode: http.StatusProxyAuthRequired},
+		{name: "not basic", cfg: AuthConfig{Users: users}, remoteAddr: "10.0.0.1:5000", header: "Bearer token", wantCode: http.StatusProxyAuthRequired},
+		{name: "broken base64", cfg: AuthConfig{Users: users}, remoteAddr: "10.0.0.1:5000", header: "Basic !!!", wantCode: http.StatusProxyAuthRequired},
+		{name: "ip is checked before credentials", cfg: AuthConfig{Users: users, AllowIPs: []string{"10.0.0.1"}}, remoteAddr: "10.0.0.2:5000", header: basicAuth("alice", "secret"), wantCode: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, err := newAuthenticator(tt.cfg, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "http://site.ton/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			if tt.header != "" {
+				req.Header.Set("Proxy-Authorization", tt.header)
+			}
+
+			wr := httptest.NewRecorder()
+			user, ok := a.authorize(wr, req)
+			if ok != (tt.wantCode == http.StatusOK) {
+				t.Fatalf("want allowed %v, got %v", tt.wantCode == http.StatusOK, ok)
+			}
+			if user != tt.wantUser {
+				t.Fatalf("want user %q, got %q", tt.wantUser, user)
+			}
+			if wr.Code != tt.wantCode {
+				t.Fatalf("want status %d, got %d", tt.wantCode, wr.Code)
+			}
+			if tt.wantCode == http.StatusProxyAuthRequired && wr.Header().Get("Proxy-Authenticate") == "" {
+				t.Fatal("no Proxy-Authenticate header")
+			}
+		})
+	}
+}
+
+func TestCheckCredentialsCache(t *testing.T) {
+	a, err := newAuthenticator(AuthConfig{Users: []AuthUser{{Name: "alice", PasswordHash: testPasswordHash(t, "secret")}}}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, ok := a.checkCredentials(basicAuth("alice", "secret")); !ok {
+			t.Fatalf("valid credentials rejected on attempt %d", i+1)
+		}
+	}
+
+	// cached credentials should not let other password in
+	if _, ok := a.checkCredentials(basicAuth("alice", "secret2")); ok {
+		t.Fatal("wrong password accepted after cached one")
+	}
+}
+
+func TestHashPassword(t *testing.T) {
+	hash, err := HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = newAuthenticator(AuthConfig{Users: []AuthUser{{Name: "alice", PasswordHash: hash}}}, ""); err != nil {
+		t.Fatalf("generated hash is not accepted: %v", err)
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte("secret")) != nil {
+		t.Fatal("hash does not match password")
+	}
+}
@@ -0,0 +1,49 @@
+package proxy
+
+import (
+	"errors"
+	"net/http"
+)
+
+func (p *proxy) do(req *http.Request) (*http.Response, error) {
+	if p.stopping.Load() {
+		return nil, ErrNotRunning
+	}
+	if req.URL.Host == "" {
+		return nil, errors.New("url should be absolute")
+	}
+	if req.Host == "" {
+		req.Host = req.URL.Host
+	}
+	if req.URL.Scheme == "" {
+		req.URL.Scheme = "http"
+	}
+
+	rule := p.router.match(req.Host)
+	switch rule.Action {
+	case RouteBlock:
+		return nil, errors.New("blocked by routing rules")
+	case RouteRLDP, RouteStorage:
+		return p.transport.RoundTrip(req)
+	}
+
+	if p.blockHttp.Load() {
+		return nil, errors.New("HTTP not allowed")
+	}
+
+	c := *p.web2Client(rule)
+	c.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	return c.Do(req)
+}
+
+// web2Client - returns client for ordinary internet request matched by rule
+func (p *proxy) web2Client(rule *RoutingRule) *http.Client {
+	if rule.client != nil {
+		return rule.client
+	} else if rule.Action == RouteUpstream {
+		return p.upstream
+	}
+	return p.web2
+}
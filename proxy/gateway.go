@@ -0,0 +1,279 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+type ClientLimits struct {
+	// RequestsPerSecond - average rate of requests, 0 is unlimited
+	RequestsPerSecond float64
+	// Burst - number of extra requests allowed above the rate at once
+	Burst int
+	// MaxConcurrent - max number of requests in progress, 0 is unlimited
+	MaxConcurrent int
+	// MaxBytes - max bytes transferred during quota period, 0 is unlimited
+	MaxBytes int64
+	// MaxTunnelBytes - max bytes transferred through paid adnl tunnel during quota period, 0 is unlimited
+	MaxTunnelBytes int64
+}
+
+type GatewayConfig struct {
+	// Default - limits of each client which has no own limits
+	Default ClientLimits
+	// Clients - limits by auth user name or client ip
+	Clients map[string]ClientLimits
+	// QuotaPeriodHours - how often byte quotas are reset, 24 when 0
+	QuotaPeriodHours int
+}
+
+var errQuotaExceeded = errors.New("traffic quota exceeded")
+
+// idle clients are removed when nothing is lost with them: no active requests, quota period is over
+// or nothing was transferred, and rate limit tokens are refilled
+const _GatewayPruneInterval = time.Minute
+const _GatewayIdleTimeout = 10 * time.Minute
+
+type ClientUsage struct {
+	Client        string
+	Active        int
+	Requests      uint64
+	Rejected      uint64
+	Bytes         int64
+	TunnelBytes   int64
+	QuotaResetsAt time.Time
+}
+
+type gatewayClient struct {
+	limits ClientLimits
+
+	tokens     float64
+	lastRefill time.Time
+	lastSeen   time.Time
+	usage      ClientUsage
+}
+
+type gateway struct {
+	cfg       GatewayConfig
+	period    time.Duration
+	clients   map[string]*gatewayClient
+	lastPrune time.Time
+	mx        sync.Mutex
+}
+
+func newGateway(cfg GatewayConfig) *gateway {
+	period := time.Duration(cfg.QuotaPeriodHours) * time.Hour
+	if period <= 0 {
+		period = 24 * time.Hour
+	}
+
+	return &gateway{
+		cfg:     cfg,
+		period:  period,
+		clients: map[string]*gatewayClient{},
+	}
+}
+
+// clientKey - clients are identified by auth user, or by ip when auth is not used
+func clientKey(user string, req *http.Request) string {
+	if user != "" {
+		return user
+	}
+
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		return host
+	}
+	return req.RemoteAddr
+}
+
+// acquire - checks limits of the client and reserves a request slot, release must be called when done
+func (g *gateway) acquire(key string, viaTunnel bool) (*gatewayClient, int, string) {
+	g.mx.Lock()
+	defer g.mx.Unlock()
+
+	now := time.Now()
+	if now.Sub(g.lastPrune) >= _GatewayPruneInterval {
+		g.prune(now)
+	}
+
+	c := g.clients[key]
+	if c == nil {
+		limits, ok := g.cfg.Clients[key]
+		if !ok {
+			limits = g.cfg.Default
+		}
+
+		c = &gatewayClient{
+			limits:     limits,
+			tokens:     float64(limits.Burst) + 1,
+			lastRefill: now,
+			usage: ClientUsage{
+				Client:        key,
+				QuotaResetsAt: now.Add(g.period),
+			},
+		}
+		g.clients[key] = c
+	}
+	c.lastSeen = now
+
+	if now.After(c.usage.QuotaResetsAt) {
+		c.usage.Bytes = 0
+		c.usage.TunnelBytes = 0
+		c.usage.QuotaResetsAt = now.Add(g.period)
+	}
+
+	if c.limits.RequestsPerSecond > 0 {
+		c.tokens += now.Sub(c.lastRefill).Seconds() * c.limits.RequestsPerSecond
+		if limit := float64(c.limits.Burst) + 1; c.tokens > limit {
+			c.tokens = limit
+		}
+		c.lastRefill = now
+
+		if c.tokens < 1 {
+			c.usage.Rejected++
+			return nil, http.StatusTooManyRequests, "Too many requests"
+		}
+	}
+
+	if c.limits.MaxConcurrent > 0 && c.usage.Active >= c.limits.MaxConcurrent {
+		c.usage.Rejected++
+		return nil, http.StatusTooManyRequests, "Too many concurrent requests"
+	}
+
+	if c.quotaExceeded(viaTunnel) {
+		c.usage.Rejected++
+		return nil, http.StatusTooManyRequests, "Traffic quota exceeded, it will be reset at " + c.usage.QuotaResetsAt.Format(time.RFC1123)
+	}
+
+	if c.limits.RequestsPerSecond > 0 {
+		c.tokens--
+	}
+	c.usage.Active++
+	c.usage.Requests++
+	return c, 0, ""
+}
+
+// prune - removes idle clients, must be called under gateway lock
+func (g *gateway) prune(now time.Time) {
+	g.lastPrune = now
+	for key, c := range g.clients {
+		if c.idle(now) {
+			delete(g.clients, key)
+		}
+	}
+}
+
+// idle - client could be forgotten, because it would be created with the same state again
+func (c *gatewayClient) idle(now time.Time) bool {
+	if c.usage.Active > 0 || now.Sub(c.lastSeen) < _GatewayIdleTimeout {
+		return false
+	}
+
+	if !now.After(c.usage.QuotaResetsAt) && (c.usage.Bytes > 0 || c.usage.TunnelBytes > 0) {
+		return false
+	}
+
+	if c.limits.RequestsPerSecond > 0 {
+		tokens := c.tokens + now.Sub(c.lastRefill).Seconds()*c.limits.RequestsPerSecond
+		if tokens < float64(c.limits.Burst)+1 {
+			return false
+		}
+	}
+	return true
+}
+
+// quotaExceeded - must be called under gateway lock
+func (c *gatewayClient) quotaExceeded(viaTunnel bool) bool {
+	if c.limits.MaxBytes > 0 && c.usage.Bytes >= c.limits.MaxBytes {
+		return true
+	}
+	return viaTunnel && c.limits.MaxTunnelBytes > 0 && c.usage.TunnelBytes >= c.limits.MaxTunnelBytes
+}
+
+// account - adds transferred bytes to client usage, returns error when quota is exceeded
+func (g *gateway) account(c *gatewayClient, n int64, viaTunnel bool) error {
+	g.mx.Lock()
+	defer g.mx.Unlock()
+
+	c.usage.Bytes += n
+	if viaTunnel {
+		c.usage.TunnelBytes += n
+	}
+
+	if c.quotaExceeded(viaTunnel) {
+		return errQuotaExceeded
+	}
+	return nil
+}
+
+func (g *gateway) release(c *gatewayClient) {
+	g.mx.Lock()
+	defer g.mx.Unlock()
+
+	c.usage.Active--
+}
+
+func (g *gateway) getUsage() []ClientUsage {
+	g.mx.Lock()
+	defer g.mx.Unlock()
+
+	list := make([]ClientUsage, 0, len(g.clients))
+	for _, c := range g.clients {
+		list = append(list, c.usage)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Client < list[j].Client
+	})
+	return list
+}
+
+// quotaWriter - counts response bytes of the client and interrupts transfer when quota is exceeded
+type quotaWriter struct {
+	http.ResponseWriter
+	gateway   *gateway
+	client    *gatewayClient
+	viaTunnel bool
+}
+
+func (w *quotaWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	if qErr := w.gateway.account(w.client, int64(n), w.viaTunnel); qErr != nil && err == nil {
+		err = qErr
+	}
+	return n, err
+}
+
+func (w *quotaWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *quotaWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// quotaBody - counts request body bytes of the client as they are read, so chunked uploads are charged too,
+// and interrupts upload when quota is exceeded
+type quotaBody struct {
+	io.ReadCloser
+	gateway   *gateway
+	client    *gatewayClient
+	viaTunnel bool
+}
+
+func (b *quotaBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		if qErr := b.gateway.account(b.client, int64(n), b.viaTunnel); qErr != nil && err == nil {
+			err = qErr
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,281 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGatewayRateLimit(t *testing.T) {
+	tests := []struct {
+		name   string
+		limits ClientLimits
+		// elapsed - time passed since previous request, for each request
+		elapsed []time.Duration
+		want    []bool
+	}{
+		{
+			name:    "unlimited",
+			elapsed: []time.Duration{0, 0, 0, 0},
+			want:    []bool{true, true, true, true},
+		},
+		{
+			name:    "single request without burst",
+			limits:  ClientLimits{RequestsPerSecond: 1},
+			elapsed: []time.Duration{0, 0, time.Second, 0},
+			want:    []bool{true, false, true, false},
+		},
+		{
+			name:    "burst",
+			limits:  ClientLimits{RequestsPerSecond: 1, Burst: 2},
+			elapsed: []time.Duration{0, 0, 0, 0, 500 * time.Millisecond, 500 * time.Millisecond},
+			want:    []bool{true, true, true, false, false, true},
+		},
+		{
+			name:    "refill is capped by burst",
+			limits:  ClientLimits{RequestsPerSecond: 10, Burst: 1},
+			elapsed: []time.Duration{0, time.Hour, 0, 0},
+			want:    []bool{true, true, true, false},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := newGateway(GatewayConfig{Default: tt.limits})
+			g.lastPrune = time.Now()
+
+			for i, elapsed := range tt.elapsed {
+				if c := g.clients["alice"]; c != nil {
+					// move time back instead of sleeping
+					c.lastRefill = c.lastRefill.Add(-elapsed)
+				}
+
+				c, code, _ := g.acquire("alice", false)
+				if (c != nil) != tt.want[i] {
+					t.Fatalf("request %d: want allowed %v, got code %d", i+1, tt.want[i], code)
+				}
+				if c == nil {
+					if code != http.StatusTooManyRequests {
+						t.Fatalf("request %d: want status 429, got %d", i+1, code)
+					}
+					continue
+				}
+				g.release(c)
+			}
+		})
+	}
+}
+
+func TestGatewayConcurrency(t *testing.T) {
+	g := newGateway(GatewayConfig{Default: ClientLimits{MaxConcurrent: 2}})
+
+	a, _, _ := g.acquire("alice", false)
+	b, _, _ := g.acquire("alice", false)
+	if a == nil || b == nil {
+		t.Fatal("requests under limit rejected")
+	}
+
+	if c, _, _ := g.acquire("alice", false); c != nil {
+		t.Fatal("request over concurrency limit allowed")
+	}
+	if c, _, _ := g.acquire("bob", false); c == nil {
+		t.Fatal("limit of one client affected another")
+	}
+
+	g.release(a)
+	if c, _, _ := g.acquire("alice", false); c == nil {
+		t.Fatal("request rejected after release")
+	}
+
+	if usage := g.getUsage(); usage[0].Client != "alice" || usage[0].Active != 2 || usage[0].Requests != 3 || usage[0].Rejected != 1 {
+		t.Fatalf("unexpected usage %+v", usage[0])
+	}
+}
+
+func TestGatewayQuota(t *testing.T) {
+	tests := []struct {
+		name      string
+		limits    ClientLimits
+		used      int64
+		usedTun   bool
+		viaTunnel bool
+		want      bool
+	}{
+		{name: "under quota", limits: ClientLimits{MaxBytes: 100}, used: 99, want: true},
+		{name: "quota reached", limits: ClientLimits{MaxBytes: 100}, used: 100, want: false},
+		{name: "tunnel quota reached", limits: ClientLimits{MaxTunnelBytes: 100}, used: 100, usedTun: true, viaTunnel: true, want: false},
+		{name: "tunnel quota does not limit direct requests", limits: ClientLimits{MaxTunnelBytes: 100}, used: 100, usedTun: true, want: true},
+		{name: "direct traffic is not charged to tunnel quota", limits: ClientLimits{MaxTunnelBytes: 100}, used: 100, viaTunnel: true, want: true},
+		{name: "tunnel traffic is charged to total quota", limits: ClientLimits{MaxBytes: 100}, used: 100, usedTun: true, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := newGateway(GatewayConfig{Default: tt.limits})
+
+			c, _, _ := g.acquire("alice", tt.usedTun)
+			if c == nil {
+				t.Fatal("first request rejected")
+			}
+			_ = g.account(c, tt.used, tt.usedTun)
+			g.release(c)
+
+			c, code, msg := g.acquire("alice", tt.viaTunnel)
+			if (c != nil) != tt.want {
+				t.Fatalf("want allowed %v, got code %d %s", tt.want, code, msg)
+			}
+			if c == nil && !strings.Contains(msg, "quota") {
+				t.Fatalf("unexpected rejection reason %q", msg)
+			}
+		})
+	}
+}
+
+func TestGatewayQuotaReset(t *testing.T) {
+	g := newGateway(GatewayConfig{Default: ClientLimits{MaxBytes: 10}, QuotaPeriodHours: 1})
+
+	c, _, _ := g.acquire("alice", false)
+	if err := g.account(c, 10, false); !errors.Is(err, errQuotaExceeded) {
+		t.Fatalf("want quota error, got %v", err)
+	}
+	g.release(c)
+
+	if c, _, _ = g.acquire("alice", false); c != nil {
+		t.Fatal("request allowed over quota")
+	}
+
+	g.clients["alice"].usage.QuotaResetsAt = time.Now().Add(-time.Second)
+	if c, _, _ = g.acquire("alice", false); c == nil {
+		t.Fatal("request rejected after quota period")
+	}
+	if resets := time.Until(c.usage.QuotaResetsAt); resets < 59*time.Minute || resets > time.Hour {
+		t.Fatalf("quota period is not restarted, resets in %s", resets)
+	}
+}
+
+func TestGatewayClientLimits(t *testing.T) {
+	g := newGateway(GatewayConfig{
+		Default: ClientLimits{MaxConcurrent: 1},
+		Clients: map[string]ClientLimits{"alice": {}},
+	})
+
+	for i := 0; i < 3; i++ {
+		if c, _, _ := g.acquire("alice", false); c == nil {
+			t.Fatal("client with own limits got default ones")
+		}
+	}
+
+	_, _, _ = g.acquire("bob", false)
+	if c, _, _ := g.acquire("bob", false); c != nil {
+		t.Fatal("client without own limits is not limited by default ones")
+	}
+}
+
+func TestGatewayPrune(t *testing.T) {
+	now := time.Now()
+	idle := now.Add(-_GatewayIdleTimeout - time.Second)
+
+	tests := []struct {
+		name   string
+		limits ClientLimits
+		client gatewayClient
+		want   bool
+	}{
+		{
+			name:   "idle",
+			client: gatewayClient{lastSeen: idle, usage: ClientUsage{QuotaResetsAt: now.Add(time.Hour)}},
+			want:   true,
+		},
+		{
+			name:   "recently seen",
+			client: gatewayClient{lastSeen: now, usage: ClientUsage{QuotaResetsAt: now.Add(time.Hour)}},
+		},
+		{
+			name:   "active request",
+			client: gatewayClient{lastSeen: idle, usage: ClientUsage{Active: 1, QuotaResetsAt: now.Add(time.Hour)}},
+		},
+		{
+			name:   "quota is used",
+			client: gatewayClient{lastSeen: idle, usage: ClientUsage{Bytes: 10, QuotaResetsAt: now.Add(time.Hour)}},
+		},
+		{
+			name:   "quota period is over",
+			client: gatewayClient{lastSeen: idle, usage: ClientUsage{Bytes: 10, TunnelBytes: 10, QuotaResetsAt: now.Add(-time.Second)}},
+			want:   true,
+		},
+		{
+			name:   "rate limit is not refilled",
+			limits: ClientLimits{RequestsPerSecond: 0.001, Burst: 1},
+			client: gatewayClient{lastSeen: idle, lastRefill: idle, usage: ClientUsage{QuotaResetsAt: now.Add(time.Hour)}},
+		},
+		{
+			name:   "rate limit is refilled",
+			limits: ClientLimits{RequestsPerSecond: 1, Burst: 1},
+			client: gatewayClient{lastSeen: idle, lastRefill: idle, usage: ClientUsage{QuotaResetsAt: now.Add(time.Hour)}},
+			want:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := newGateway(GatewayConfig{})
+			c := tt.client
+			c.limits = tt.limits
+			g.clients["alice"] = &c
+
+			g.prune(now)
+			if _, ok := g.clients["alice"]; ok == tt.want {
+				t.Fatalf("want pruned %v, got %v", tt.want, !ok)
+			}
+		})
+	}
+}
+
+func TestQuotaBody(t *testing.T) {
+	g := newGateway(GatewayConfig{Default: ClientLimits{MaxBytes: 10}})
+	c, _, _ := g.acquire("alice", false)
+
+	body := &quotaBody{ReadCloser: io.NopCloser(strings.NewReader(strings.Repeat("a", 25))), gateway: g, client: c}
+	data, err := io.ReadAll(io.LimitReader(&smallReader{body}, 100))
+	if !errors.Is(err, errQuotaExceeded) {
+		t.Fatalf("want quota error, got %v", err)
+	}
+	if len(data) >= 25 {
+		t.Fatal("upload is not interrupted")
+	}
+	if c.usage.Bytes != int64(len(data)) {
+		t.Fatalf("want %d bytes charged, got %d", len(data), c.usage.Bytes)
+	}
+}
+
+func TestQuotaWriter(t *testing.T) {
+	g := newGateway(GatewayConfig{Default: ClientLimits{MaxTunnelBytes: 5}})
+	c, _, _ := g.acquire("alice", true)
+
+	wr := &quotaWriter{ResponseWriter: httptest.NewRecorder(), gateway: g, client: c, viaTunnel: true}
+	if _, err := wr.Write([]byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := wr.Write([]byte("def")); !errors.Is(err, errQuotaExceeded) {
+		t.Fatalf("want quota error, got %v", err)
+	}
+	if c.usage.Bytes != 6 || c.usage.TunnelBytes != 6 {
+		t.Fatalf("want 6 bytes charged, got %d and %d", c.usage.Bytes, c.usage.TunnelBytes)
+	}
+}
+
+// smallReader - reads by 4 bytes, like network does by packets
+type smallReader struct {
+	r io.Reader
+}
+
+func (s *smallReader) Read(p []byte) (int, error) {
+	if len(p) > 4 {
+		p = p[:4]
+	}
+	return s.r.Read(p)
+}
@@ -0,0 +1,308 @@
+package proxy
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	tunnelConfig "github.com/ton-blockchain/adnl-tunnel/config"
+	"github.com/ton-blockchain/adnl-tunnel/tunnel"
+	"github.com/xssnick/tonutils-go/liteclient"
+	"github.com/xssnick/tonutils-go/tlb"
+	"github.com/xssnick/tonutils-proxy/proxy/accesslog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// ErrNotRunning - proxy is not started or already stopped
+	ErrNotRunning = errors.New("proxy is not running")
+	// ErrAlreadyStarted - proxy instance is already running
+	ErrAlreadyStarted = errors.New("proxy is already started")
+	// ErrTunnelInUse - adnl tunnel settings are global, so only one proxy in process could use it
+	ErrTunnelInUse = errors.New("tunnel is already used by another proxy in this process")
+)
+
+// tunnelOwner - proxy which is running with tunnel
+var tunnelOwner atomic.Pointer[Proxy]
+
+// Options - configuration of proxy instance
+type Options struct {
+	// ListenAddr - address of http proxy server, when empty proxy is not listening,
+	// and requests could be made only in process using Proxy.Do
+	ListenAddr string
+	// ADNLKey - key of adnl gateway, random key is used when empty
+	ADNLKey ed25519.PrivateKey
+	// Version - sent to sites in X-Tonutils-Proxy header
+	Version   string
+	BlockHttp bool
+
+	// NetworkConfig - ton network config, when nil it is loaded from NetworkConfigPath,
+	// or downloaded from NetworkConfigURL when path is empty too
+	NetworkConfig     *liteclient.GlobalConfig
+	NetworkConfigPath string
+	// NetworkConfigURL - config is re-downloaded from it periodically, to pick up changed liteservers and dht nodes.
+	// DefaultNetworkConfigURL is used when config is downloaded and url is empty. Passed or loaded from disk config
+	// is refreshed only when url is set explicitly, because it could be config of other network.
+	NetworkConfigURL string
+	// NetworkConfigCacheDir - directory where last successfully downloaded network config is stored,
+	// it is used instead of built-in fallback when download fails. Empty value disables cache.
+	NetworkConfigCacheDir string
+	// NetworkConfigRefreshInterval - how often network config is re-downloaded, DefaultNetworkConfigRefreshInterval when zero
+	NetworkConfigRefreshInterval time.Duration
+
+	// Auth - access control of proxy listener
+	Auth AuthConfig
+	// RoutingRules - rules evaluated in order to decide how to route request, DefaultRoutingRules are used when empty
+	RoutingRules []RoutingRule
+	// Upstream - when set, web2 requests are sent through upstream proxy
+	Upstream *UpstreamConfig
+	// Gateway - when set, proxy serves many clients with limits per each of them
+	Gateway *GatewayConfig
+	// AccessLog - when set, every proxied request is written to it, it is not closed by proxy
+	AccessLog *accesslog.Logger
+	// PACDomains - additional domains to route through proxy in PAC file, subdomains are included
+	PACDomains []string
+	// AdminAPIToken - bearer token required to use admin api at http://proxy.local/api/,
+	// empty value disables the api
+	AdminAPIToken string
+	// MetricsListenAddr - address to serve prometheus metrics on, empty value disables it
+	MetricsListenAddr string
+	// RLDPConnectionsPerSite - max number of parallel rldp connections to a single site,
+	// DefaultRLDPConnectionsPerSite when zero
+	RLDPConnectionsPerSite int
+
+	// ShutdownTimeout - max time to wait for active transfers on stop, DefaultShutdownTimeout when zero
+	ShutdownTimeout time.Duration
+
+	// Tunnel - adnl tunnel client config, tunnel is not used when nil
+	Tunnel *tunnelConfig.ClientConfig
+	// TunnelNetworkConfig - custom network config for tunnel payments, NetworkConfig is used when nil
+	TunnelNetworkConfig *liteclient.GlobalConfig
+	// TunnelWeb2 - when enabled, web2 requests are sent through tunnel exit nodes too, so site sees exit node ip.
+	// Tunnel carries only udp, so sites are reached over HTTP/3, sites without it are not available in this mode.
+	TunnelWeb2 bool
+	// TunnelWeb2DoH - DNS over HTTPS server used to resolve web2 domains through the tunnel, must be ip address,
+	// DefaultTunnelWeb2DoH when empty
+	TunnelWeb2DoH string
+
+	// OnState - receives loading states, called synchronously from proxy goroutines
+	OnState func(state State)
+	// OnTunnel - external address of tunnel changed
+	OnTunnel func(addr string)
+	// OnPaidUpdate - total amount paid for tunnel
+	OnPaidUpdate func(paid tlb.Coins)
+	// OnAskAccept - decides on proposed tunnel route, returns one of tunnel.AcceptorDecision*, accepts when nil
+	OnAskAccept func(to, from []*tunnel.SectionInfo) int
+	// OnAskReroute - tunnel is broken, true to build new route, false to wait
+	OnAskReroute    func() bool
+	OnTunnelStopped func()
+}
+
+// Proxy - proxy instance, several of them could run in one process
+type Proxy struct {
+	opts Options
+
+	handler atomic.Pointer[proxy]
+
+	state State
+	ready chan struct{}
+	stop  context.CancelFunc
+	done  chan struct{}
+	err   error
+
+	mx sync.Mutex
+}
+
+// New - creates proxy instance, it should be started with Start
+func New(opts Options) *Proxy {
+	return &Proxy{
+		opts:  opts,
+		state: State{Type: "stopped", State: "not started", Stopped: true},
+	}
+}
+
+// RunProxy - runs proxy until closerCtx is done, states are sent to res when it is not nil
+//
+// Deprecated: use New with Options, it supports all settings and several instances in one process.
+func RunProxy(closerCtx context.Context, addr string, adnlKey ed25519.PrivateKey, res chan<- State, versionAndDevice string, blockHttp bool, netConfigPath string, tunCfg *tunnelConfig.ClientConfig, customTunNetCfg *liteclient.GlobalConfig) error {
+	return runUntilDone(closerCtx, res, Options{
+		ListenAddr:          addr,
+		ADNLKey:             adnlKey,
+		Version:             versionAndDevice,
+		BlockHttp:           blockHttp,
+		NetworkConfigPath:   netConfigPath,
+		Tunnel:              tunCfg,
+		TunnelNetworkConfig: customTunNetCfg,
+	})
+}
+
+// RunProxyWithConfig - runs proxy with passed network config until closerCtx is done, states are sent to res when it is not nil
+//
+// Deprecated: use New with Options, it supports all settings and several instances in one process.
+func RunProxyWithConfig(closerCtx context.Context, addr string, adnlKey ed25519.PrivateKey, res chan<- State, blockHttp bool, versionAndDevice string, lsCfg *liteclient.GlobalConfig, tunCfg *tunnelConfig.ClientConfig, customTunNetCfg *liteclient.GlobalConfig) error {
+	return runUntilDone(closerCtx, res, Options{
+		ListenAddr:          addr,
+		ADNLKey:             adnlKey,
+		Version:             versionAndDevice,
+		BlockHttp:           blockHttp,
+		NetworkConfig:       lsCfg,
+		Tunnel:              tunCfg,
+		TunnelNetworkConfig: customTunNetCfg,
+	})
+}
+
+func runUntilDone(ctx context.Context, res chan<- State, opts Options) error {
+	if res != nil {
+		opts.OnState = func(s State) {
+			res <- s
+		}
+	}
+
+	p := New(opts)
+	stop := context.AfterFunc(ctx, p.Stop)
+	defer stop()
+
+	if err := p.Start(); err != nil {
+		return err
+	}
+	if ctx.Err() != nil {
+		// cancelled before stop could be requested
+		p.Stop()
+	}
+	return p.Wait()
+}
+
+// Start - starts proxy in background and waits until it is ready, returns error when it is failed to start.
+// Stopped proxy could be started again.
+func (p *Proxy) Start() error {
+	p.mx.Lock()
+	if p.done != nil {
+		select {
+		case <-p.done:
+		default:
+			p.mx.Unlock()
+			return ErrAlreadyStarted
+		}
+	}
+
+	ctx, stop := context.WithCancel(context.Background())
+	ready, done := make(chan struct{}, 1), make(chan struct{})
+	p.stop, p.ready, p.done, p.err = stop, ready, done, nil
+	p.mx.Unlock()
+
+	go func() {
+		defer close(done)
+		defer stop()
+
+		err := p.run(ctx)
+
+		p.mx.Lock()
+		p.err = err
+		p.mx.Unlock()
+
+		if st := p.State(); err != nil && !st.Stopped {
+			p.report(State{Type: "error", State: err.Error(), Stopped: true})
+		} else if !st.Stopped {
+			p.report(State{Type: "stopped", State: "Stopped", Stopped: true})
+		}
+	}()
+
+	select {
+	case <-ready:
+		return nil
+	case <-done:
+		if err := p.Wait(); err != nil {
+			return err
+		}
+		return errors.New("proxy was stopped before it became ready")
+	}
+}
+
+// Stop - initiates graceful stop, new requests are rejected and active transfers are awaited up to ShutdownTimeout,
+// Wait could be used to wait for its completion
+func (p *Proxy) Stop() {
+	p.mx.Lock()
+	stop := p.stop
+	p.mx.Unlock()
+
+	if stop != nil {
+		stop()
+	}
+}
+
+// Wait - waits until proxy is stopped, returns error which stopped it, nil when it was stopped by Stop
+func (p *Proxy) Wait() error {
+	p.mx.Lock()
+	done := p.done
+	p.mx.Unlock()
+
+	if done == nil {
+		return nil
+	}
+	<-done
+
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	return p.err
+}
+
+// Status - returns status of sites, bags and tunnel, false when proxy is not running
+func (p *Proxy) Status() (Status, bool) {
+	h := p.handler.Load()
+	if h == nil {
+		return Status{}, false
+	}
+	return h.getStatus(), true
+}
+
+// State - returns last reported state
+func (p *Proxy) State() State {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	return p.state
+}
+
+// Do - performs request through proxy in process, without listening socket,
+// request is routed like it came to proxy, so ton sites go over rldp and storage.
+// Redirects are not followed.
+func (p *Proxy) Do(req *http.Request) (*http.Response, error) {
+	h := p.handler.Load()
+	if h == nil {
+		return nil, ErrNotRunning
+	}
+	return h.do(req)
+}
+
+func (p *Proxy) report(s State) {
+	p.mx.Lock()
+	p.state = s
+	ready := p.ready
+	p.mx.Unlock()
+
+	if s.Type == "ready" {
+		select {
+		case ready <- struct{}{}:
+		default:
+		}
+	}
+
+	if p.opts.OnState != nil {
+		p.opts.OnState(s)
+	}
+}
+
+func (p *Proxy) askAccept(to, from []*tunnel.SectionInfo) int {
+	if p.opts.OnAskAccept == nil {
+		return tunnel.AcceptorDecisionAccept
+	}
+	return p.opts.OnAskAccept(to, from)
+}
+
+func (p *Proxy) askReroute() bool {
+	if p.opts.OnAskReroute == nil {
+		return false
+	}
+	return p.opts.OnAskReroute()
+}
@@ -0,0 +1,133 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"time"
+)
+
+const namespace = "tonutils_proxy"
+
+var Registry = prometheus.NewRegistry()
+
+var (
+	Requests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "requests_total",
+		Help:      "Number of proxied requests by host type and status class.",
+	}, []string{"host_type", "status"})
+
+	RequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "request_duration_seconds",
+		Help:      "Time spent to fully proxy request, including body transfer.",
+		Buckets:   []float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60},
+	}, []string{"host_type"})
+
+	RouteRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "route_requests_total",
+		Help:      "Number of proxied requests by action of matched routing rule and status class.",
+	}, []string{"route", "status"})
+
+	DNSResolveDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "dns_resolve_duration_seconds",
+		Help:      "Time spent to resolve domain in TON DNS.",
+		Buckets:   []float64{.05, .1, .25, .5, 1, 2.5, 5, 10},
+	})
+
+	DHTResolveDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "dht_resolve_duration_seconds",
+		Help:      "Time spent to find site address in DHT.",
+		Buckets:   []float64{.05, .1, .25, .5, 1, 2.5, 5, 10},
+	})
+
+	RLDPBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rldp_bytes_total",
+		Help:      "Payload bytes transferred over RLDP, by direction.",
+	}, []string{"direction"})
+
+	ActiveSites = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "active_sites",
+		Help:      "Number of sites with active connection or bag.",
+	}, []string{"type"})
+
+	BagPieces = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "bag_pieces_downloaded_total",
+		Help:      "Number of bag pieces downloaded from storage.",
+	})
+
+	BagBytes = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "bag_bytes_downloaded_total",
+		Help:      "Bytes of bag pieces downloaded from storage.",
+	})
+
+	TunnelPaid = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "tunnel_paid_ton",
+		Help:      "Amount of TON paid for ADNL tunnel during current session.",
+	})
+)
+
+func init() {
+	Registry.MustRegister(
+		Requests,
+		RequestDuration,
+		RouteRequests,
+		DNSResolveDuration,
+		DHTResolveDuration,
+		RLDPBytes,
+		ActiveSites,
+		BagPieces,
+		BagBytes,
+		TunnelPaid,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+// Serve - starts metrics http listener, blocks until ctx is done
+func Serve(ctx context.Context, addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(Registry, promhttp.HandlerOpts{}))
+
+	server := http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		_ = server.Close()
+	}()
+
+	log.Info().Str("address", addr).Msg("Starting metrics server")
+
+	err := server.ListenAndServe()
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// StatusClass - returns status label value, like 2xx
+func StatusClass(code int) string {
+	switch {
+	case code < 200:
+		return "1xx"
+	case code < 300:
+		return "2xx"
+	case code < 400:
+		return "3xx"
+	case code < 500:
+		return "4xx"
+	}
+	return "5xx"
+}
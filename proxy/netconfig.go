@@ -0,0 +1,336 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"github.com/xssnick/tonutils-go/adnl"
+	"github.com/xssnick/tonutils-go/adnl/address"
+	"github.com/xssnick/tonutils-go/adnl/dht"
+	"github.com/xssnick/tonutils-go/liteclient"
+	"github.com/xssnick/tonutils-go/ton/dns"
+	"github.com/xssnick/tonutils-storage/config"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultNetworkConfigURL - mainnet config, downloaded when config is not passed
+const DefaultNetworkConfigURL = "https://ton-blockchain.github.io/global.config.json"
+const networkConfigCacheFile = "network-config.json"
+
+// DefaultNetworkConfigRefreshInterval - how often network config is re-downloaded in background, when not set in Options
+const DefaultNetworkConfigRefreshInterval = 30 * time.Minute
+
+// downloadNetworkConfig - downloads network config, through upstream proxy when it is configured for it
+func downloadNetworkConfig(ctx context.Context, url string, upstream *UpstreamConfig) (*liteclient.GlobalConfig, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := networkConfigClient(upstream)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download network config: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to download network config, status %d", resp.StatusCode)
+	}
+
+	cfg := &liteclient.GlobalConfig{}
+	if err = json.NewDecoder(resp.Body).Decode(cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse network config: %w", err)
+	}
+	return cfg, nil
+}
+
+func (p *Proxy) fetchNetworkConfig(ctx context.Context, url string) (*liteclient.GlobalConfig, error) {
+	log.Info().Msg("Fetching TON network config...")
+	cfg, err := downloadNetworkConfig(ctx, url, p.opts.Upstream)
+	if err == nil && len(cfg.Liteservers) > 0 {
+		if err = saveCachedNetworkConfig(p.opts.NetworkConfigCacheDir, cfg); err != nil {
+			log.Warn().Err(err).Msg("Failed to save ton config to cache")
+		}
+		return cfg, nil
+	}
+	if err == nil {
+		err = fmt.Errorf("no liteservers in downloaded config")
+	}
+
+	if cfg, cErr := loadCachedNetworkConfig(p.opts.NetworkConfigCacheDir); cErr == nil {
+		log.Error().Err(err).Msg("Failed to download ton config; taking it from local cache")
+		return cfg, nil
+	} else if !os.IsNotExist(cErr) {
+		log.Warn().Err(cErr).Msg("Failed to load cached ton config")
+	}
+
+	log.Error().Err(err).Msg("Failed to download ton config; taking it from static cache")
+	cfg = &liteclient.GlobalConfig{}
+	if err = json.NewDecoder(bytes.NewBufferString(config.FallbackNetworkConfig)).Decode(cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse fallback ton config: %w", err)
+	}
+	return cfg, nil
+}
+
+func loadCachedNetworkConfig(dir string) (*liteclient.GlobalConfig, error) {
+	if dir == "" {
+		return nil, os.ErrNotExist
+	}
+
+	cfg, err := liteclient.GetConfigFromFile(filepath.Join(dir, networkConfigCacheFile))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(cfg.Liteservers) == 0 {
+		return nil, fmt.Errorf("no liteservers in cached config")
+	}
+	return cfg, nil
+}
+
+func saveCachedNetworkConfig(dir string, cfg *liteclient.GlobalConfig) error {
+	if dir == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(cfg, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(dir, networkConfigCacheFile)
+	// write to temp file first, to not corrupt cache if we crash in the middle
+	if err = os.WriteFile(path+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// liteserversKey - returns string which is equal for configs with the same set of liteservers
+func liteserversKey(cfg *liteclient.GlobalConfig) string {
+	list := make([]string, 0, len(cfg.Liteservers))
+	for _, ls := range cfg.Liteservers {
+		list = append(list, fmt.Sprintf("%d:%d:%s", ls.IP, ls.Port, ls.ID.Key))
+	}
+	sort.Strings(list)
+
+	var buf bytes.Buffer
+	for _, s := range list {
+		buf.WriteString(s)
+		buf.WriteByte(';')
+	}
+	return buf.String()
+}
+
+// dhtNodesKey - returns string which is equal for configs with the same set of static dht nodes
+func dhtNodesKey(cfg *liteclient.GlobalConfig) string {
+	list := make([]string, 0, len(cfg.DHT.StaticNodes.Nodes))
+	for _, n := range cfg.DHT.StaticNodes.Nodes {
+		for _, a := range n.AddrList.Addrs {
+			list = append(list, fmt.Sprintf("%d:%d:%s", a.IP, a.Port, n.ID.Key))
+		}
+	}
+	sort.Strings(list)
+
+	var buf bytes.Buffer
+	for _, s := range list {
+		buf.WriteString(s)
+		buf.WriteByte(';')
+	}
+	return buf.String()
+}
+
+// initDHT - starts dht client on its own gateway, gateway is closed together with client
+func initDHT(netMgr adnl.NetManager, cfg *liteclient.GlobalConfig) (*dht.Client, error) {
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate ed25519 dht adnl key: %w", err)
+	}
+
+	gateway := adnl.NewGatewayWithNetManager(key, netMgr)
+	if err = gateway.StartClient(); err != nil {
+		return nil, fmt.Errorf("failed to start adnl gateway: %w", err)
+	}
+
+	client, err := dht.NewClientFromConfig(gateway, cfg)
+	if err != nil {
+		_ = gateway.Close()
+		return nil, fmt.Errorf("failed to init DHT client: %w", err)
+	}
+	return client, nil
+}
+
+// switchableDHT - dht client for site lookups, which can be rebuilt with new static nodes on the fly.
+// Storage server keeps base client, because it cannot be replaced there, it is closed separately.
+type switchableDHT struct {
+	base    *dht.Client
+	client  *dht.Client
+	stopped bool
+	mx      sync.RWMutex
+}
+
+func newSwitchableDHT(base *dht.Client) *switchableDHT {
+	return &switchableDHT{base: base, client: base}
+}
+
+func (s *switchableDHT) get() *dht.Client {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	return s.client
+}
+
+func (s *switchableDHT) FindAddresses(ctx context.Context, key []byte) (*address.List, ed25519.PublicKey, error) {
+	return s.get().FindAddresses(ctx, key)
+}
+
+func (s *switchableDHT) StoreAddress(ctx context.Context, addresses address.List, ttl time.Duration, ownerKey ed25519.PrivateKey, copies int) (int, []byte, error) {
+	return s.get().StoreAddress(ctx, addresses, ttl, ownerKey, copies)
+}
+
+// Close - closes rebuilt client, base one is not touched
+func (s *switchableDHT) Close() {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	s.stopped = true
+	if s.client != s.base {
+		s.client.Close()
+	}
+	s.client = s.base
+}
+
+func (s *switchableDHT) switchTo(client *dht.Client) {
+	s.mx.Lock()
+	if s.stopped {
+		s.mx.Unlock()
+		client.Close()
+		return
+	}
+	old := s.client
+	s.client = client
+	s.mx.Unlock()
+
+	if old != s.base {
+		// give in-flight lookups some time to complete
+		time.AfterFunc(30*time.Second, old.Close)
+	}
+}
+
+// switchableResolver - dns resolver which underlying liteserver pool can be replaced on the fly
+type switchableResolver struct {
+	pool    *liteclient.ConnectionPool
+	client  *dns.Client
+	stopped bool
+	mx      sync.RWMutex
+}
+
+func (s *switchableResolver) Resolve(ctx context.Context, domain string) (*dns.Domain, error) {
+	s.mx.RLock()
+	client := s.client
+	s.mx.RUnlock()
+
+	return client.Resolve(ctx, domain)
+}
+
+func (s *switchableResolver) switchTo(pool *liteclient.ConnectionPool, client *dns.Client) {
+	s.mx.Lock()
+	if s.stopped {
+		s.mx.Unlock()
+		pool.Stop()
+		return
+	}
+	old := s.pool
+	s.pool, s.client = pool, client
+	s.mx.Unlock()
+
+	if old != nil {
+		// give in-flight resolves some time to complete
+		time.AfterFunc(30*time.Second, old.Stop)
+	}
+}
+
+func (s *switchableResolver) stop() {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	s.stopped = true
+	if s.pool != nil {
+		s.pool.Stop()
+		s.pool = nil
+	}
+}
+
+// refreshNetworkConfig - periodically downloads config from url, and rebuilds dns resolver and dht client
+// when their servers are changed
+func (p *Proxy) refreshNetworkConfig(ctx context.Context, url string, current *liteclient.GlobalConfig, resolver *switchableResolver,
+	dhtClient *switchableDHT, netMgr adnl.NetManager) {
+	interval := p.opts.NetworkConfigRefreshInterval
+	if interval <= 0 {
+		interval = DefaultNetworkConfigRefreshInterval
+	}
+
+	currentKey, currentDHTKey := liteserversKey(current), dhtNodesKey(current)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+
+		cfg, err := downloadNetworkConfig(ctx, url, p.opts.Upstream)
+		if err != nil {
+			log.Warn().Err(err).Msg("failed to refresh ton network config")
+			continue
+		}
+
+		if len(cfg.Liteservers) == 0 {
+			log.Warn().Msg("refreshed ton network config has no liteservers, ignoring")
+			continue
+		}
+
+		if err = saveCachedNetworkConfig(p.opts.NetworkConfigCacheDir, cfg); err != nil {
+			log.Warn().Err(err).Msg("failed to save ton config to cache")
+		}
+
+		if key := dhtNodesKey(cfg); key != currentDHTKey && len(cfg.DHT.StaticNodes.Nodes) > 0 {
+			log.Info().Int("nodes", len(cfg.DHT.StaticNodes.Nodes)).Msg("dht nodes list changed, rebuilding dht client")
+
+			client, err := initDHT(netMgr, cfg)
+			if err != nil {
+				log.Warn().Err(err).Msg("failed to init dht client with refreshed config, keeping old one")
+			} else {
+				dhtClient.switchTo(client)
+				currentDHTKey = key
+			}
+		}
+
+		key := liteserversKey(cfg)
+		if key == currentKey {
+			continue
+		}
+
+		log.Info().Int("liteservers", len(cfg.Liteservers)).Msg("liteservers list changed, rebuilding pool")
+
+		pool, client, err := initDNSResolver(ctx, cfg)
+		if err != nil {
+			log.Warn().Err(err).Msg("failed to init dns resolver with refreshed config, keeping old one")
+			continue
+		}
+
+		resolver.switchTo(pool, client)
+		currentKey = key
+	}
+}
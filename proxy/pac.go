@@ -0,0 +1,241 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"regexp/syntax"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// PACPath - path of proxy auto-config file, served on proxy address and on StatusHost
+const PACPath = "/proxy.pac"
+
+// GeneratePAC - returns proxy auto-config script which routes domains matched by rules and extra domains
+// through proxy at addr, and everything else directly
+func GeneratePAC(addr string, rules []RoutingRule, extra []string) (string, error) {
+	r, err := newRouter(rules)
+	if err != nil {
+		return "", err
+	}
+	return r.pac(addr, extra), nil
+}
+
+func (r *router) pac(addr string, extra []string) string {
+	proxyRet := fmt.Sprintf("return \"PROXY %s\";", addr)
+
+	var sb strings.Builder
+	sb.WriteString("function FindProxyForURL(url, host) {\n")
+	sb.WriteString("\thost = host.toLowerCase();\n")
+
+	for _, d := range extra {
+		d = strings.ToLower(strings.Trim(strings.TrimSpace(d), "."))
+		if d == "" {
+			continue
+		}
+		fmt.Fprintf(&sb, "\tif (host == %q || dnsDomainIs(host, %q)) %s\n", d, "."+d, proxyRet)
+	}
+
+	for _, rule := range r.rules {
+		ret := proxyRet
+		if rule.Action == RouteDirect {
+			ret = "return \"DIRECT\";"
+		}
+
+		if rule.re != nil {
+			re, err := jsRegex(rule.re.String())
+			if err != nil {
+				// browser cannot evaluate this and next rules, so proxy decides, it evaluates the same rules
+				fmt.Fprintf(&sb, "\t%s\n}\n", proxyRet)
+				return sb.String()
+			}
+			fmt.Fprintf(&sb, "\tif (new RegExp(%q).test(host)) %s\n", re, ret)
+		} else if rule.withDomain {
+			fmt.Fprintf(&sb, "\tif (host == %q || dnsDomainIs(host, %q)) %s\n", rule.suffix, "."+rule.suffix, ret)
+		} else {
+			fmt.Fprintf(&sb, "\tif (dnsDomainIs(host, %q)) %s\n", "."+rule.suffix, ret)
+		}
+	}
+
+	if r.fallback.Action == RouteDirect {
+		sb.WriteString("\treturn \"DIRECT\";\n}\n")
+	} else {
+		fmt.Fprintf(&sb, "\t%s\n}\n", proxyRet)
+	}
+	return sb.String()
+}
+
+// jsRegex - translates go regular expression to javascript one with the same meaning for host names,
+// because go specific syntax, like (?i), \z or (?P<name>), breaks the whole pac script.
+// Hosts are lower-cased before matching, so case folding is not needed.
+func jsRegex(expr string) (string, error) {
+	re, err := syntax.Parse(expr, syntax.Perl)
+	if err != nil {
+		return "", err
+	}
+
+	var sb strings.Builder
+	if err = writeJSRegex(&sb, re.Simplify()); err != nil {
+		return "", err
+	}
+	return sb.String(), nil
+}
+
+func writeJSRegex(sb *strings.Builder, re *syntax.Regexp) error {
+	switch re.Op {
+	case syntax.OpNoMatch:
+		sb.WriteString(`[^\s\S]`)
+	case syntax.OpEmptyMatch:
+		sb.WriteString(`(?:)`)
+	case syntax.OpLiteral:
+		for _, r := range re.Rune {
+			if re.Flags&syntax.FoldCase != 0 {
+				r = unicode.ToLower(r)
+			}
+			writeJSRune(sb, r, false)
+		}
+	case syntax.OpCharClass:
+		sb.WriteByte('[')
+		for i := 0; i < len(re.Rune); i += 2 {
+			lo, hi := re.Rune[i], re.Rune[i+1]
+			if lo > 0xFFFF {
+				// astral characters cannot be in class without unicode flag, and they are not in hosts anyway
+				continue
+			}
+			if hi > 0xFFFF {
+				hi = 0xFFFF
+			}
+			writeJSRune(sb, lo, true)
+			if hi != lo {
+				sb.WriteByte('-')
+				writeJSRune(sb, hi, true)
+			}
+		}
+		if len(re.Rune) == 0 || re.Rune[0] > 0xFFFF {
+			sb.WriteString(`^\s\S`)
+		}
+		sb.WriteByte(']')
+	case syntax.OpAnyCharNotNL:
+		sb.WriteByte('.')
+	case syntax.OpAnyChar:
+		sb.WriteString(`[\s\S]`)
+	case syntax.OpBeginLine, syntax.OpBeginText:
+		sb.WriteByte('^')
+	case syntax.OpEndLine, syntax.OpEndText:
+		sb.WriteByte('$')
+	case syntax.OpWordBoundary:
+		sb.WriteString(`\b`)
+	case syntax.OpNoWordBoundary:
+		sb.WriteString(`\B`)
+	case syntax.OpCapture:
+		sb.WriteByte('(')
+		if err := writeJSRegex(sb, re.Sub[0]); err != nil {
+			return err
+		}
+		sb.WriteByte(')')
+	case syntax.OpStar, syntax.OpPlus, syntax.OpQuest, syntax.OpRepeat:
+		sb.WriteString("(?:")
+		if err := writeJSRegex(sb, re.Sub[0]); err != nil {
+			return err
+		}
+		sb.WriteByte(')')
+
+		switch re.Op {
+		case syntax.OpStar:
+			sb.WriteByte('*')
+		case syntax.OpPlus:
+			sb.WriteByte('+')
+		case syntax.OpQuest:
+			sb.WriteByte('?')
+		default:
+			sb.WriteString("{" + strconv.Itoa(re.Min))
+			if re.Max != re.Min {
+				sb.WriteByte(',')
+				if re.Max >= 0 {
+					sb.WriteString(strconv.Itoa(re.Max))
+				}
+			}
+			sb.WriteByte('}')
+		}
+		if re.Flags&syntax.NonGreedy != 0 {
+			sb.WriteByte('?')
+		}
+	case syntax.OpConcat:
+		for _, sub := range re.Sub {
+			if err := writeJSRegex(sb, sub); err != nil {
+				return err
+			}
+		}
+	case syntax.OpAlternate:
+		sb.WriteString("(?:")
+		for i, sub := range re.Sub {
+			if i > 0 {
+				sb.WriteByte('|')
+			}
+			if err := writeJSRegex(sb, sub); err != nil {
+				return err
+			}
+		}
+		sb.WriteByte(')')
+	default:
+		return fmt.Errorf("unsupported regex operation %s", re.Op)
+	}
+	return nil
+}
+
+// writeJSRune - writes escaped rune, non ascii ones as utf-16 escapes
+func writeJSRune(sb *strings.Builder, r rune, inClass bool) {
+	switch {
+	case r > 0xFFFF:
+		r1, r2 := utf16Surrogates(r)
+		fmt.Fprintf(sb, `\u%04x\u%04x`, r1, r2)
+	case r < 0x20 || r > 0x7E:
+		fmt.Fprintf(sb, `\u%04x`, r)
+	case inClass && strings.ContainsRune(`\]^-[`, r):
+		sb.WriteByte('\\')
+		sb.WriteRune(r)
+	case !inClass && strings.ContainsRune(`\^$.|?*+()[]{}/`, r):
+		sb.WriteByte('\\')
+		sb.WriteRune(r)
+	default:
+		sb.WriteRune(r)
+	}
+}
+
+func utf16Surrogates(r rune) (rune, rune) {
+	r -= 0x10000
+	return 0xD800 + (r>>10)&0x3FF, 0xDC00 + r&0x3FF
+}
+
+// PACURL - returns url of pac file served by proxy listening on addr
+func PACURL(addr string) string {
+	return "http://" + reachableAddr(addr) + PACPath
+}
+
+// reachableAddr - replaces unspecified listen address with loopback
+func reachableAddr(addr string) string {
+	if host, port, err := net.SplitHostPort(addr); err == nil && (host == "" || host == "0.0.0.0" || host == "::") {
+		return net.JoinHostPort("127.0.0.1", port)
+	}
+	return addr
+}
+
+// isPACRequest - true when pac file is requested directly from proxy, not through it, or from StatusHost
+func isPACRequest(req *http.Request) bool {
+	return req.Method == http.MethodGet && req.URL.Path == PACPath && (!req.URL.IsAbs() || isStatusHost(req.Host))
+}
+
+func (p *proxy) servePAC(wr http.ResponseWriter, req *http.Request) {
+	addr := p.addr
+	if !isStatusHost(req.Host) && req.Host != "" {
+		// use the same address which was used by client to reach us
+		addr = req.Host
+	}
+	addr = reachableAddr(addr)
+
+	wr.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+	wr.Header().Set("Cache-Control", "no-store")
+	_, _ = wr.Write([]byte(p.router.pac(addr, p.pacDomains)))
+}
@@ -0,0 +1,149 @@
+package proxy
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestJSRegex(t *testing.T) {
+	tests := []struct {
+		expr string
+		want string
+	}{
+		{expr: `^example\.com$`, want: `^example\.com$`},
+		{expr: `(?i)^Example\.COM$`, want: `^example\.com$`},
+		{expr: `\.ton\z`, want: `\.ton$`},
+		{expr: `^(?P<sub>[a-z]+)\.example\.org$`, want: `^((?:[a-z])+)\.example\.org$`},
+		{expr: `^a{2,}b{1,3}c*?$`, want: `^a(?:a)+b(?:b(?:b)?)?(?:c)*?$`},
+		{expr: `^[^.]+\.t\.me$`, want: `^(?:[\u0000-\-/-\uffff])+\.t\.me$`},
+		{expr: `^\d+\.\w+$`, want: `^(?:[0-9])+\.(?:[0-9A-Z_a-z])+$`},
+		{expr: `foo|bar`, want: `(?:foo|bar)`},
+		{expr: `^/path$`, want: `^\/path$`},
+		{expr: `^é\.рф$`, want: `^\u00e9\.\u0440\u0444$`},
+		{expr: `\bton\B`, want: `\bton\B`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			got, err := jsRegex(tt.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Fatalf("want %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestGeneratePAC(t *testing.T) {
+	const proxyRet = `return "PROXY 127.0.0.1:8080";`
+
+	tests := []struct {
+		name  string
+		rules []RoutingRule
+		extra []string
+		want  []string
+	}{
+		{
+			name:  "default rules",
+			rules: DefaultRoutingRules(),
+			want: []string{
+				`if (dnsDomainIs(host, ".ton")) ` + proxyRet,
+				`if (dnsDomainIs(host, ".t.me")) ` + proxyRet,
+				`if (dnsDomainIs(host, ".adnl")) ` + proxyRet,
+				`if (dnsDomainIs(host, ".bag")) ` + proxyRet,
+				`return "DIRECT";`,
+			},
+		},
+		{
+			name:  "extra domains go first",
+			rules: []RoutingRule{{Suffix: ".ton", Action: RouteRLDP}},
+			extra: []string{" .Extra.Org. ", ""},
+			want: []string{
+				`if (host == "extra.org" || dnsDomainIs(host, ".extra.org")) ` + proxyRet,
+				`if (dnsDomainIs(host, ".ton")) ` + proxyRet,
+				`return "DIRECT";`,
+			},
+		},
+		{
+			name: "direct and blocked domains",
+			rules: []RoutingRule{
+				{Suffix: "example.com", Action: RouteDirect},
+				{Suffix: "ads.com", Action: RouteBlock},
+			},
+			want: []string{
+				`if (host == "example.com" || dnsDomainIs(host, ".example.com")) return "DIRECT";`,
+				// blocked requests should reach proxy to be rejected
+				`if (host == "ads.com" || dnsDomainIs(host, ".ads.com")) ` + proxyRet,
+				`return "DIRECT";`,
+			},
+		},
+		{
+			name:  "regex",
+			rules: []RoutingRule{{Regex: `(?i)^X\.org\z`, Action: RouteUpstream, Upstream: "http://10.0.0.1:3128"}},
+			want: []string{
+				`if (new RegExp("^x\\.org$").test(host)) ` + proxyRet,
+				`return "DIRECT";`,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pac, err := GeneratePAC("127.0.0.1:8080", tt.rules, tt.extra)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want := "function FindProxyForURL(url, host) {\n\thost = host.toLowerCase();\n\t" +
+				strings.Join(tt.want, "\n\t") + "\n}\n"
+			if pac != want {
+				t.Fatalf("want:\n%s\ngot:\n%s", want, pac)
+			}
+		})
+	}
+}
+
+func TestGeneratePACInvalidRules(t *testing.T) {
+	if _, err := GeneratePAC("127.0.0.1:8080", []RoutingRule{{Regex: `(`, Action: RouteRLDP}}, nil); err == nil {
+		t.Fatal("invalid regex accepted")
+	}
+}
+
+func TestPACUpstreamFallback(t *testing.T) {
+	r, err := newRouter([]RoutingRule{{Suffix: "example.com", Action: RouteDirect}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.fallback = upstreamRule
+
+	pac := r.pac("127.0.0.1:8080", nil)
+	if !strings.HasSuffix(pac, "\t"+`return "PROXY 127.0.0.1:8080";`+"\n}\n") {
+		t.Fatalf("not matched hosts should go through proxy to upstream:\n%s", pac)
+	}
+}
+
+func TestIsPACRequest(t *testing.T) {
+	tests := []struct {
+		method string
+		target string
+		want   bool
+	}{
+		{method: "GET", target: "/proxy.pac", want: true},
+		{method: "GET", target: "http://" + StatusHost + "/proxy.pac", want: true},
+		{method: "GET", target: "http://example.com/proxy.pac", want: false},
+		{method: "POST", target: "/proxy.pac", want: false},
+		{method: "GET", target: "/other.pac", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.target, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.target, nil)
+			if got := isPACRequest(req); got != tt.want {
+				t.Fatalf("want %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
@@ -1,11 +1,9 @@
 package proxy
 
 import (
-	"bytes"
 	"context"
 	"crypto/ed25519"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"github.com/rs/zerolog/log"
 	tunnelConfig "github.com/ton-blockchain/adnl-tunnel/config"
@@ -13,23 +11,30 @@ import (
 	"github.com/xssnick/tonutils-go/address"
 	"github.com/xssnick/tonutils-go/adnl"
 	adnlAddress "github.com/xssnick/tonutils-go/adnl/address"
-	"github.com/xssnick/tonutils-go/adnl/dht"
 	"github.com/xssnick/tonutils-go/liteclient"
-	"github.com/xssnick/tonutils-go/tlb"
 	"github.com/xssnick/tonutils-go/ton"
 	"github.com/xssnick/tonutils-go/ton/dns"
+	"github.com/xssnick/tonutils-proxy/proxy/accesslog"
+	"github.com/xssnick/tonutils-proxy/proxy/metrics"
+	"github.com/xssnick/tonutils-proxy/proxy/tracing"
 	"github.com/xssnick/tonutils-proxy/proxy/transport"
-	"github.com/xssnick/tonutils-storage/config"
 	"github.com/xssnick/tonutils-storage/storage"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"io"
 	"net"
 	"net/http"
 	"os"
 	"runtime"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
+var tracer = tracing.Tracer("proxy")
+
 // Hop-by-hop headers. These are removed when sent to the backend.
 // http://www.w3.org/Protocols/rfc2616/rfc2616-sec13.html
 var hopHeaders = []string{
@@ -68,23 +73,81 @@ func appendHostToXForwardHeader(header http.Header, host string) {
 }
 
 type proxy struct {
+	addr      string
 	version   string
-	blockHttp bool
+	blockHttp atomic.Bool
+	startedAt time.Time
+	transport *transport.Transport
+	rldp      *http.Client
+	tunnel    *tunnelState
+	auth      *authenticator
+	router    *router
+	web2      *http.Client
+	upstream  *http.Client
+	gateway   *gateway
+	accessLog *accesslog.Logger
+
+	// adminToken - admin api is disabled when empty
+	adminToken string
+	pacDomains []string
+
+	// web2Tunneled - web2 client sends requests through tunnel
+	web2Tunneled bool
+	// stopping - proxy is draining active transfers, new requests are rejected
+	stopping atomic.Bool
 }
 
-var client *http.Client
-
 func (p *proxy) ServeHTTP(wr http.ResponseWriter, req *http.Request) {
+	if p.stopping.Load() {
+		// requests on kept alive connections may still come while active transfers are drained
+		wr.Header().Set("Connection", "close")
+		http.Error(wr, "Proxy is stopping", http.StatusServiceUnavailable)
+		return
+	}
+
 	if req.URL.Scheme == "" {
 		// if no scheme - we check forwarded proto
 		req.URL.Scheme = req.Header.Get("X-Forwarded-Proto")
 	}
 
+	if isPACRequest(req) {
+		p.servePAC(wr, req)
+		return
+	}
+
+	start, path := time.Now(), req.URL.RequestURI()
+
+	var rec *accessRecorder
+	if p.accessLog != nil {
+		rec = &accessRecorder{ResponseWriter: wr}
+		wr = rec
+	}
+
+	user, ok := p.auth.authorize(wr, req)
+	if !ok {
+		if rec != nil {
+			// rejected clients are logged too, to see who tries to use the proxy
+			p.logAccess(req, rec, p.router.match(req.Host), "", path, start)
+		}
+		return
+	}
+
 	if req.Method == "CONNECT" {
 		wr.WriteHeader(http.StatusOK)
 		return
 	}
 
+	if isStatusHost(req.Host) {
+		p.serveStatus(wr, req)
+		return
+	}
+
+	rule := p.router.match(req.Host)
+
+	if rec != nil {
+		defer p.logAccess(req, rec, rule, user, path, start)
+	}
+
 	if req.URL.Scheme == "" {
 		req.URL.Scheme = "http"
 	}
@@ -106,19 +169,59 @@ func (p *proxy) ServeHTTP(wr http.ResponseWriter, req *http.Request) {
 	}
 	req.Header.Set("X-Tonutils-Proxy", p.version)
 
-	var c = http.DefaultClient
-	if strings.HasSuffix(req.Host, ".ton") || strings.HasSuffix(req.Host, ".adnl") ||
-		strings.HasSuffix(req.Host, ".t.me") || strings.HasSuffix(req.Host, ".bag") {
+	typ, route := hostType(req.Host), string(rule.Action)
+	status := "error"
+
+	ctx, span := tracer.Start(req.Context(), "proxy request", trace.WithAttributes(
+		tracing.Host(req.Host), attribute.String("method", req.Method),
+		attribute.String("host_type", typ), attribute.String("route", route)))
+	req = req.WithContext(ctx)
+
+	defer func() {
+		span.SetAttributes(attribute.String("status", status))
+		span.End()
+
+		metrics.Requests.WithLabelValues(typ, status).Inc()
+		metrics.RequestDuration.WithLabelValues(typ).Observe(time.Since(start).Seconds())
+		metrics.RouteRequests.WithLabelValues(route, status).Inc()
+	}()
+
+	var c *http.Client
+	switch rule.Action {
+	case RouteBlock:
+		status = "blocked"
+		http.Error(wr, "Blocked by routing rules", http.StatusForbidden)
+		return
+	case RouteRLDP, RouteStorage:
 		log.Debug().Str("method", req.Method).Str("url", req.URL.String()).Msg("over rldp")
 		// proxy requests to ton using special client
-		c = client
-	} else {
-		if p.blockHttp {
+		c = p.rldp
+	default:
+		if p.blockHttp.Load() {
+			status = "blocked"
 			http.Error(wr, "HTTP Not allowed", http.StatusBadRequest)
 			return
 		}
 
-		log.Debug().Str("method", req.Method).Str("url", req.URL.String()).Msg("over http")
+		c = p.web2Client(rule)
+		log.Debug().Str("method", req.Method).Str("url", req.URL.String()).Str("route", route).Msg("over http")
+	}
+
+	// limits are checked only for requests which are going to be sent, blocked ones don't use quota
+	if p.gateway != nil {
+		viaTunnel := p.viaTunnel(rule)
+		gc, code, msg := p.gateway.acquire(clientKey(user, req), viaTunnel)
+		if gc == nil {
+			status = "limited"
+			http.Error(wr, msg, code)
+			return
+		}
+		defer p.gateway.release(gc)
+
+		if req.Body != nil && req.Body != http.NoBody {
+			req.Body = &quotaBody{ReadCloser: req.Body, gateway: p.gateway, client: gc, viaTunnel: viaTunnel}
+		}
+		wr = &quotaWriter{ResponseWriter: wr, gateway: p.gateway, client: gc, viaTunnel: viaTunnel}
 	}
 
 	resp, err := c.Do(req)
@@ -130,9 +233,12 @@ func (p *proxy) ServeHTTP(wr http.ResponseWriter, req *http.Request) {
 			http.Error(wr, "RLDP Proxy Error:\n"+text, http.StatusBadGateway)
 		}
 		log.Warn().Str("err", text).Str("method", req.Method).Str("url", req.URL.String()).Msg("cannot open")
+		span.RecordError(err)
+		span.SetStatus(codes.Error, text)
 		return
 	}
 	defer resp.Body.Close()
+	status = metrics.StatusClass(resp.StatusCode)
 
 	log.Debug().Str("status", resp.Status).Str("addr", req.RemoteAddr).Msg("loading")
 
@@ -143,70 +249,144 @@ func (p *proxy) ServeHTTP(wr http.ResponseWriter, req *http.Request) {
 	io.Copy(wr, resp.Body)
 }
 
+const (
+	hostTypeTON  = "ton"
+	hostTypeADNL = "adnl"
+	hostTypeBag  = "bag"
+	hostTypeWeb2 = "web2"
+)
+
+// hostType - metrics label of host, it doesn't depend on routing rules
+func hostType(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	switch {
+	case strings.HasSuffix(host, ".ton"), strings.HasSuffix(host, ".t.me"):
+		return hostTypeTON
+	case strings.HasSuffix(host, ".adnl"):
+		return hostTypeADNL
+	case strings.HasSuffix(host, ".bag"):
+		return hostTypeBag
+	}
+	return hostTypeWeb2
+}
+
 type State struct {
 	Type    string
 	State   string
 	Stopped bool
 }
 
-func RunProxy(closerCtx context.Context, addr string, adnlKey ed25519.PrivateKey, res chan<- State, versionAndDevice string, blockHttp bool, netConfigPath string, tunCfg *tunnelConfig.ClientConfig, customTunNetCfg *liteclient.GlobalConfig) error {
-	if res != nil {
-		res <- State{
-			Type:  "loading",
-			State: "Fetching network config...",
-		}
-	}
+// DefaultRLDPConnectionsPerSite - max number of parallel rldp connections to a single site, when not set in Options
+const DefaultRLDPConnectionsPerSite = 3
+
+// run - runs proxy until ctx is done
+func (p *Proxy) run(ctx context.Context) error {
+	addr, report := p.opts.ListenAddr, p.report
+	adnlKey, tunCfg, customTunNetCfg := p.opts.ADNLKey, p.opts.Tunnel, p.opts.TunnelNetworkConfig
 
 	var err error
-	var lsCfg *liteclient.GlobalConfig
-	if netConfigPath != "" {
-		log.Info().Msg("Fetching TON network config from disk...")
-		lsCfg, err = liteclient.GetConfigFromFile(netConfigPath)
-		if err != nil {
-			return fmt.Errorf("failed to parse ton config: %w", err)
-		}
-	} else {
-		log.Info().Msg("Fetching TON network config...")
-		lsCfg, err = liteclient.GetConfigFromUrl(context.Background(), "https://ton-blockchain.github.io/global.config.json")
+	if len(adnlKey) == 0 {
+		_, adnlKey, err = ed25519.GenerateKey(nil)
 		if err != nil {
-			log.Error().Err(err).Msg("Failed to download ton config; taking it from static cache")
-			lsCfg = &liteclient.GlobalConfig{}
-			if err = json.NewDecoder(bytes.NewBufferString(config.FallbackNetworkConfig)).Decode(lsCfg); err != nil {
-				return fmt.Errorf("failed to parse fallback ton config: %w", err)
-			}
+			return fmt.Errorf("failed to generate ed25519 adnl key: %w", err)
 		}
 	}
 
-	return RunProxyWithConfig(closerCtx, addr, adnlKey, res, blockHttp, versionAndDevice, lsCfg, tunCfg, customTunNetCfg)
-}
+	auth, err := newAuthenticator(p.opts.Auth, addr)
+	if err != nil {
+		return err
+	}
 
-var OnTunnel = func(addr string) {}
-var OnPaidUpdate = func(paid tlb.Coins) {}
+	rules := p.opts.RoutingRules
+	if len(rules) == 0 {
+		rules = DefaultRoutingRules()
+	}
 
-var OnAskAccept = func(to, from []*tunnel.SectionInfo) int {
-	return tunnel.AcceptorDecisionAccept
-}
-var OnAskReroute = func() bool { return false }
+	router, err := newRouter(rules)
+	if err != nil {
+		return fmt.Errorf("invalid routing rules: %w", err)
+	}
 
-var OnTunnelStopped = func() {}
+	hasUpstream := p.opts.Upstream != nil && p.opts.Upstream.URL != ""
+	if p.opts.TunnelWeb2 && p.opts.Tunnel != nil && (hasUpstream || router.hasUpstream) {
+		return fmt.Errorf("web2 through tunnel cannot be used together with upstream proxy or upstream-proxy routing rules, disable one of them")
+	}
 
-func RunProxyWithConfig(closerCtx context.Context, addr string, adnlKey ed25519.PrivateKey, res chan<- State, blockHttp bool, versionAndDevice string, lsCfg *liteclient.GlobalConfig, tunCfg *tunnelConfig.ClientConfig, customTunNetCfg *liteclient.GlobalConfig) error {
-	report := func(s State) {
-		if res != nil {
-			res <- s
+	upstream := (*http.Client)(nil)
+	if hasUpstream {
+		upstream, err = newUpstreamClient(p.opts.Upstream)
+		if err != nil {
+			return err
 		}
+		// rules with direct action are still accessed directly
+		router.fallback = upstreamRule
+	} else if router.needUpstream {
+		return fmt.Errorf("routing rules use upstream proxy, but it is not configured")
 	}
 
-	var err error
-	if len(adnlKey) == 0 {
-		_, adnlKey, err = ed25519.GenerateKey(nil)
-		if err != nil {
-			return fmt.Errorf("failed to generate ed25519 adnl key: %w", err)
+	lsCfg, refreshURL := p.opts.NetworkConfig, p.opts.NetworkConfigURL
+	if lsCfg == nil {
+		report(State{
+			Type:  "loading",
+			State: "Fetching network config...",
+		})
+
+		if p.opts.NetworkConfigPath != "" {
+			log.Info().Msg("Fetching TON network config from disk...")
+			lsCfg, err = liteclient.GetConfigFromFile(p.opts.NetworkConfigPath)
+			if err != nil {
+				return fmt.Errorf("failed to parse ton config: %w", err)
+			}
+		} else {
+			if refreshURL == "" {
+				refreshURL = DefaultNetworkConfigURL
+			}
+
+			lsCfg, err = p.fetchNetworkConfig(ctx, refreshURL)
+			if err != nil {
+				return err
+			}
 		}
 	}
 
-	ctx, closer := context.WithCancel(closerCtx)
-	defer closer()
+	// components live until active transfers are drained, so they have own context
+	compCtx, closer := context.WithCancel(context.Background())
+
+	var steps shutdownSteps
+	defer func() {
+		if ctx.Err() != nil {
+			steps.close(report)
+			return
+		}
+		steps.close(nil)
+	}()
+	steps.add("network", func() {
+		closer()
+		tunnelOwner.CompareAndSwap(p, nil)
+	})
+
+	// stop before proxy is ready interrupts its startup
+	var ready atomic.Bool
+	go func() {
+		select {
+		case <-ctx.Done():
+			if !ready.Load() {
+				closer()
+			}
+		case <-compCtx.Done():
+		}
+	}()
+
+	if p.opts.MetricsListenAddr != "" {
+		go func() {
+			if err := metrics.Serve(compCtx, p.opts.MetricsListenAddr); err != nil {
+				log.Error().Err(err).Msg("Failed to start metrics server")
+			}
+		}()
+	}
 
 	report(State{
 		Type:  "loading",
@@ -214,15 +394,25 @@ func RunProxyWithConfig(closerCtx context.Context, addr string, adnlKey ed25519.
 	})
 
 	log.Info().Msg("Initializing DNS resolver...")
-	connPool, dnsClient, err := initDNSResolver(lsCfg)
+	connPool, dnsClient, err := initDNSResolver(compCtx, lsCfg)
 	if err != nil {
 		return fmt.Errorf("failed to init TON DNS resolver: %w", err)
 	}
-	defer connPool.Stop()
+	resolver := &switchableResolver{pool: connPool, client: dnsClient}
+	steps.add("DNS resolver", resolver.stop)
+
+	tunState := &tunnelState{}
 
 	var gate *adnl.Gateway
 	var netMgr adnl.NetManager
+	var web2Mux *packetMux
+	var tunnelWeb2 *http.Client
+	var tunnelWeb2Close func()
 	if tunCfg != nil && tunCfg.NodesPoolConfigPath != "" {
+		tunState.update(func(st *TunnelStatus) {
+			st.Enabled = true
+		})
+
 		report(State{
 			Type:  "loading",
 			State: "Preparing ADNL tunnel...",
@@ -242,13 +432,18 @@ func RunProxyWithConfig(closerCtx context.Context, addr string, adnlKey ed25519.
 			customTunNetCfg = lsCfg
 		}
 
+		// tunnel library settings are global, so only one proxy could use it
+		if !tunnelOwner.CompareAndSwap(nil, p) {
+			return ErrTunnelInUse
+		}
+
 		tunnel.ChannelPacketsToPrepay = 30000
 		tunnel.ChannelCapacityForNumPayments = 50
 
-		tunnel.AskReroute = OnAskReroute
-		tunnel.Acceptor = OnAskAccept
+		tunnel.AskReroute = p.askReroute
+		tunnel.Acceptor = p.askAccept
 		events := make(chan any, 1)
-		go tunnel.RunTunnel(ctx, tunCfg, &tunNodesCfg, customTunNetCfg, log.Logger, events)
+		go tunnel.RunTunnel(compCtx, tunCfg, &tunNodesCfg, customTunNetCfg, log.Logger, events)
 
 		initUpd := make(chan any, 1)
 		inited := false
@@ -257,7 +452,12 @@ func RunProxyWithConfig(closerCtx context.Context, addr string, adnlKey ed25519.
 			for event := range events {
 				switch e := event.(type) {
 				case tunnel.StoppedEvent:
-					OnTunnelStopped()
+					tunState.update(func(st *TunnelStatus) {
+						st.Stopped = true
+					})
+					if p.opts.OnTunnelStopped != nil {
+						p.opts.OnTunnelStopped()
+					}
 					return
 				case tunnel.MsgEvent:
 					if !inited {
@@ -276,9 +476,20 @@ func RunProxyWithConfig(closerCtx context.Context, addr string, adnlKey ed25519.
 								Port: int32(addr.Port),
 							},
 						})
-						OnTunnel(addr.String())
+						tunState.update(func(st *TunnelStatus) {
+							st.Addr = addr.String()
+						})
+						if p.opts.OnTunnel != nil {
+							p.opts.OnTunnel(addr.String())
+						}
 					})
-					OnTunnel(fmt.Sprintf("%s:%d", e.ExtIP.String(), e.ExtPort))
+					tunState.update(func(st *TunnelStatus) {
+						st.Ready = true
+						st.Addr = fmt.Sprintf("%s:%d", e.ExtIP.String(), e.ExtPort)
+					})
+					if p.opts.OnTunnel != nil {
+						p.opts.OnTunnel(fmt.Sprintf("%s:%d", e.ExtIP.String(), e.ExtPort))
+					}
 
 					go func() {
 						for {
@@ -286,7 +497,16 @@ func RunProxyWithConfig(closerCtx context.Context, addr string, adnlKey ed25519.
 							case <-e.Tunnel.AliveCtx().Done():
 								return
 							case <-time.After(5 * time.Second):
-								OnPaidUpdate(e.Tunnel.CalcPaidAmount()["TON"])
+								paid := e.Tunnel.CalcPaidAmount()["TON"]
+								tunState.update(func(st *TunnelStatus) {
+									st.Paid = paid.String()
+								})
+								if v, err := strconv.ParseFloat(paid.String(), 64); err == nil {
+									metrics.TunnelPaid.Set(v)
+								}
+								if p.opts.OnPaidUpdate != nil {
+									p.opts.OnPaidUpdate(paid)
+								}
 							}
 						}
 					}()
@@ -294,7 +514,13 @@ func RunProxyWithConfig(closerCtx context.Context, addr string, adnlKey ed25519.
 					atm.SwitchTo(e.Tunnel)
 					if !inited {
 						inited = true
-						netMgr = adnl.NewMultiNetReader(atm)
+						if p.opts.TunnelWeb2 {
+							web2Mux = newPacketMux(atm)
+							netMgr = adnl.NewMultiNetReader(web2Mux.adnl)
+							tunnelWeb2, tunnelWeb2Close = newTunnelHTTPClient(web2Mux.web2, p.opts.TunnelWeb2DoH)
+						} else {
+							netMgr = adnl.NewMultiNetReader(atm)
+						}
 						gate = adnl.NewGatewayWithNetManager(adnlKey, netMgr)
 
 						select {
@@ -326,7 +552,15 @@ func RunProxyWithConfig(closerCtx context.Context, addr string, adnlKey ed25519.
 			}
 		}()
 
-		switch x := (<-initUpd).(type) {
+		var upd any
+		select {
+		case upd = <-initUpd:
+		case <-compCtx.Done():
+			// stopped before tunnel is ready
+			return nil
+		}
+
+		switch x := upd.(type) {
 		case tunnel.UpdatedEvent:
 			log.Info().
 				Str("ip", x.ExtIP.String()).
@@ -344,8 +578,16 @@ func RunProxyWithConfig(closerCtx context.Context, addr string, adnlKey ed25519.
 		netMgr = adnl.NewMultiNetReader(dl)
 		gate = adnl.NewGatewayWithNetManager(adnlKey, netMgr)
 	}
-	defer gate.Close()
-	defer netMgr.Close()
+	steps.add("ADNL connection", func() {
+		netMgr.Close()
+		_ = gate.Close()
+	})
+	if tunnelWeb2 != nil {
+		steps.add("web2 tunnel client", func() {
+			tunnelWeb2Close()
+			_ = web2Mux.web2.Close()
+		})
+	}
 
 	listenThreads := runtime.NumCPU()
 	if listenThreads > 32 {
@@ -358,23 +600,29 @@ func RunProxyWithConfig(closerCtx context.Context, addr string, adnlKey ed25519.
 	})
 
 	log.Info().Msg("Initializing DHT client...")
-	_, dhtAdnlKey, err := ed25519.GenerateKey(nil)
+	dhtClient, err := initDHT(netMgr, lsCfg)
 	if err != nil {
-		return fmt.Errorf("failed to generate ed25519 dht adnl key: %w", err)
+		return err
 	}
+	steps.add("DHT", dhtClient.Close)
 
-	gateway := adnl.NewGatewayWithNetManager(dhtAdnlKey, netMgr)
-	err = gateway.StartClient()
-	if err != nil {
-		return fmt.Errorf("failed to start adnl gateway: %w", err)
-	}
-	defer gateway.Close()
+	// site lookups use client which is rebuilt when dht nodes are changed in refreshed config
+	siteDHT := newSwitchableDHT(dhtClient)
+	steps.add("refreshed DHT", siteDHT.Close)
 
-	dhtClient, err := dht.NewClientFromConfig(gateway, lsCfg)
-	if err != nil {
-		return fmt.Errorf("failed to init DHT client: %w", err)
+	if refreshURL != "" {
+		refreshCtx, stopRefresh := context.WithCancel(compCtx)
+		refreshDone := make(chan struct{})
+		go func() {
+			defer close(refreshDone)
+			p.refreshNetworkConfig(refreshCtx, refreshURL, lsCfg, resolver, siteDHT, netMgr)
+		}()
+		// refresh uses resolver and dht, so it is stopped before them
+		steps.add("network config refresh", func() {
+			stopRefresh()
+			<-refreshDone
+		})
 	}
-	defer dhtClient.Close()
 
 	report(State{
 		Type:  "loading",
@@ -386,16 +634,14 @@ func RunProxyWithConfig(closerCtx context.Context, addr string, adnlKey ed25519.
 	if err != nil {
 		return fmt.Errorf("failed to generate ed25519 storage adnl key: %w", err)
 	}
-	_, proxyAdnlKey, err := ed25519.GenerateKey(nil)
-	if err != nil {
-		return fmt.Errorf("failed to generate ed25519 proxy adnl key: %w", err)
-	}
 
 	gateStorage := adnl.NewGatewayWithNetManager(storageAdnlKey, netMgr)
 	if err = gateStorage.StartClient(listenThreads); err != nil {
 		return fmt.Errorf("failed to init adnl gateway: %w", err)
 	}
-	defer gateStorage.Close()
+	steps.add("storage gateway", func() {
+		_ = gateStorage.Close()
+	})
 
 	srv := storage.NewServer(dhtClient, gateStorage, storageAdnlKey, false, 1)
 	conn := storage.NewConnector(srv)
@@ -403,85 +649,130 @@ func RunProxyWithConfig(closerCtx context.Context, addr string, adnlKey ed25519.
 	store := transport.NewVirtualStorage()
 	srv.SetStorage(store)
 
-	defer srv.Stop()
+	steps.add("storage server", srv.Stop)
 
-	gateProxy := adnl.NewGatewayWithNetManager(proxyAdnlKey, netMgr)
-	if err = gateProxy.StartClient(listenThreads); err != nil {
-		return fmt.Errorf("failed to init adnl gateway for proxy: %w", err)
+	// each gateway has its own key, so it gives separate connection to the same site
+	connsPerSite := p.opts.RLDPConnectionsPerSite
+	if connsPerSite <= 0 {
+		connsPerSite = DefaultRLDPConnectionsPerSite
+	}
+
+	gatesProxy := make([]*adnl.Gateway, connsPerSite)
+	steps.add("RLDP gateways", func() {
+		for _, g := range gatesProxy {
+			if g != nil {
+				_ = g.Close()
+			}
+		}
+	})
+	for i := range gatesProxy {
+		_, proxyAdnlKey, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			return fmt.Errorf("failed to generate ed25519 proxy adnl key: %w", err)
+		}
+
+		gatesProxy[i] = adnl.NewGatewayWithNetManager(proxyAdnlKey, netMgr)
+		if err = gatesProxy[i].StartClient(listenThreads); err != nil {
+			return fmt.Errorf("failed to init adnl gateway for proxy: %w", err)
+		}
 	}
-	defer gateProxy.Close()
 
 	report(State{
 		Type:  "loading",
 		State: "Starting HTTP server...",
 	})
 
-	t := transport.NewTransport(gateProxy, dhtClient, dnsClient, conn, store)
-	client = &http.Client{
-		Transport: t,
-		CheckRedirect: func(req *http.Request, via []*http.Request) error {
-			return http.ErrUseLastResponse
+	t := transport.NewTransport(gatesProxy, siteDHT, resolver, conn, store)
+	steps.add("transport", t.Stop)
+
+	if addr != "" {
+		log.Info().Str("address", addr).Msg("Starting proxy server")
+	}
+
+	handler := &proxy{
+		addr:      addr,
+		version:   p.opts.Version,
+		startedAt: time.Now(),
+		transport: t,
+		rldp: &http.Client{
+			Transport: t,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
 		},
+		tunnel:     tunState,
+		auth:       auth,
+		router:     router,
+		web2:       http.DefaultClient,
+		upstream:   upstream,
+		accessLog:  p.opts.AccessLog,
+		adminToken: p.opts.AdminAPIToken,
+		pacDomains: p.opts.PACDomains,
+	}
+	handler.blockHttp.Store(p.opts.BlockHttp)
+	if tunnelWeb2 != nil {
+		log.Info().Msg("web2 requests are sent through tunnel over HTTP/3")
+		handler.web2 = tunnelWeb2
+		handler.web2Tunneled = true
+	}
+	if p.opts.Gateway != nil {
+		handler.gateway = newGateway(*p.opts.Gateway)
 	}
-	defer t.Stop()
 
-	log.Info().Str("address", addr).Msg("Starting proxy server")
+	p.handler.Store(handler)
+	defer p.handler.Store(nil)
 
-	server := http.Server{Addr: addr, Handler: &proxy{blockHttp: blockHttp, version: versionAndDevice}}
+	var server *http.Server
+	serveErr := make(chan error, 1)
+	if addr != "" {
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			text := "Failed, check logs"
+			if strings.Contains(err.Error(), "address already in use") {
+				text = "Port is already in use"
+				err = fmt.Errorf("cannot start server, port %s is already in use by another application", addr)
+			}
 
-	go func() {
-		<-ctx.Done()
-		server.Shutdown(ctx)
-	}()
+			log.Error().Err(err).Msg("Failed to init proxy server")
 
-	failed := false
-	go func() {
-		// wait for server start
-		time.Sleep(1 * time.Second)
-		if failed {
-			return
+			report(State{
+				Type:    "error",
+				State:   text,
+				Stopped: true,
+			})
+			return err
 		}
 
-		report(State{
-			Type:  "ready",
-			State: "Ready",
-		})
-	}()
-
-	err = server.ListenAndServe()
-	if errors.Is(err, http.ErrServerClosed) {
-		err = nil
+		server = &http.Server{Addr: addr, Handler: handler}
+		go func() {
+			serveErr <- server.Serve(ln)
+		}()
 	}
+	// otherwise requests are made in process using Proxy.Do
 
-	if err != nil {
-		failed = true
-		if strings.Contains(err.Error(), "address already in use") {
-			err = fmt.Errorf("cannot start server, port %s is already in use by another application", addr)
-		}
-
-		log.Error().Err(err).Msg("Failed to init proxy server")
-
-		text := "Failed, check logs"
-		if strings.Contains(err.Error(), "address already in use") {
-			text = "Port is already in use"
-		}
+	ready.Store(true)
+	report(State{
+		Type:  "ready",
+		State: "Ready",
+	})
 
-		report(State{
-			Type:    "error",
-			State:   text,
-			Stopped: true,
-		})
+	select {
+	case err = <-serveErr:
+		return fmt.Errorf("proxy server failed: %w", err)
+	case <-ctx.Done():
 	}
 
-	return err
+	p.drain(handler, server)
+	return nil
 }
 
-func initDNSResolver(cfg *liteclient.GlobalConfig) (*liteclient.ConnectionPool, *dns.Client, error) {
+func initDNSResolver(ctx context.Context, cfg *liteclient.GlobalConfig) (*liteclient.ConnectionPool, *dns.Client, error) {
 	pool := liteclient.NewConnectionPool()
 
 	// connect to testnet lite server
-	err := pool.AddConnectionsFromConfig(context.Background(), cfg)
+	err := pool.AddConnectionsFromConfig(ctx, cfg)
 	if err != nil {
+		pool.Stop()
 		return nil, nil, err
 	}
 
@@ -491,14 +782,18 @@ func initDNSResolver(cfg *liteclient.GlobalConfig) (*liteclient.ConnectionPool,
 	var root *address.Address
 	for i := 0; i < 5; i++ { // retry to not get liteserver not found block err
 		// get root dns address from network config
-		root, err = dns.GetRootContractAddr(context.Background(), api)
-		if err != nil {
-			time.Sleep(500 * time.Millisecond)
-			continue
+		root, err = dns.GetRootContractAddr(ctx, api)
+		if err == nil || ctx.Err() != nil {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(500 * time.Millisecond):
 		}
-		break
 	}
 	if err != nil {
+		pool.Stop()
 		return nil, nil, err
 	}
 
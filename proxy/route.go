@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"encoding/base64"
+	"errors"
+	"github.com/ton-blockchain/adnl-tunnel/tunnel"
+	"github.com/xssnick/tonutils-go/tlb"
+	"math/big"
+)
+
+// ErrUnsupportedRouteCurrency - route has node with payment in currency other than TON
+var ErrUnsupportedRouteCurrency = errors.New("route has node with payment in currency other than TON, it is not yet supported")
+
+type RouteSection struct {
+	// Name - short id of node
+	Name string
+	// Outer - exit node of the tunnel
+	Outer bool
+}
+
+// RouteInfo - tunnel route proposed for acceptance, prices are in TON per 1 MB
+type RouteInfo struct {
+	Sections []RouteSection
+	PriceIn  string
+	PriceOut string
+}
+
+// DescribeRoute - returns sections and approximate price of tunnel route, to show it to user before accepting
+func DescribeRoute(to, from []*tunnel.SectionInfo) (RouteInfo, error) {
+	var priceIn, priceOut = big.NewInt(0), big.NewInt(0)
+	var sect []RouteSection
+	for i, n := range append(to, from...) {
+		sect = append(sect, RouteSection{
+			Name:  base64.StdEncoding.EncodeToString(n.Keys.ReceiverPubKey)[:8],
+			Outer: i == len(to)-1,
+		})
+
+		if n.PaymentInfo != nil {
+			if n.PaymentInfo.ExtraCurrencyID != 0 || n.PaymentInfo.JettonMaster != nil {
+				return RouteInfo{}, ErrUnsupportedRouteCurrency
+			}
+
+			// consider 1 packet = 512 bytes, actually more, but this is avg payload
+			var packetsPerMB int64 = 2048
+
+			amt := new(big.Int).SetUint64(n.PaymentInfo.PricePerPacket)
+			amt.Mul(amt, big.NewInt(packetsPerMB))
+
+			vcFee := big.NewInt(0)
+			for _, section := range n.PaymentInfo.PaymentTunnel {
+				vcFee.Add(vcFee, section.MinFee)
+			}
+
+			packetsPerChannel := tunnel.ChannelCapacityForNumPayments * tunnel.ChannelPacketsToPrepay
+			// channel fee per 1 mb
+			feeDiv := new(big.Float).Quo(new(big.Float).SetInt64(packetsPerMB), new(big.Float).SetInt64(packetsPerChannel))
+
+			feePer1MB, _ := feeDiv.Mul(new(big.Float).SetInt(vcFee), feeDiv).Int(vcFee)
+			amt.Add(amt, feePer1MB)
+
+			if i < len(to)-1 {
+				priceOut.Add(priceOut, amt)
+			} else if i == len(to)-1 {
+				priceOut.Add(priceOut, amt)
+				priceIn.Add(priceOut, amt)
+			} else {
+				priceIn.Add(priceOut, amt)
+			}
+		}
+	}
+
+	return RouteInfo{
+		Sections: sect,
+		PriceIn:  tlb.FromNanoTON(priceIn).String(),
+		PriceOut: tlb.FromNanoTON(priceOut).String(),
+	}, nil
+}
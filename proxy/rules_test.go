@@ -0,0 +1,230 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRouterMatch(t *testing.T) {
+	rules := []RoutingRule{
+		{Suffix: "blocked.ton", Action: RouteBlock},
+		{Suffix: ".ton", Action: RouteRLDP},
+		{Suffix: ".bag", Action: RouteStorage},
+		{Suffix: "example.com", Action: RouteDirect},
+		{Regex: `^(www\.)?corp\.(local|internal)$`, Action: RouteUpstream, Upstream: "http://10.0.0.1:3128"},
+		{Suffix: "upstream.org", Action: RouteUpstream},
+	}
+
+	tests := []struct {
+		host string
+		// want - index of matched rule, -1 for fallback
+		want int
+	}{
+		{host: "foundation.ton", want: 1},
+		{host: "FOUNDATION.TON", want: 1},
+		{host: "foundation.ton.", want: 1},
+		{host: "foundation.ton:8080", want: 1},
+		{host: "blocked.ton", want: 0},
+		{host: "sub.blocked.ton", want: 0},
+		// suffix with leading dot matches only subdomains
+		{host: "ton", want: -1},
+		{host: "notton", want: -1},
+		{host: "abc.bag", want: 2},
+		{host: "example.com", want: 3},
+		{host: "www.example.com", want: 3},
+		{host: "badexample.com", want: -1},
+		{host: "corp.local", want: 4},
+		{host: "www.corp.internal", want: 4},
+		{host: "corp.local.org", want: -1},
+		{host: "upstream.org:443", want: 5},
+		{host: "[::1]:8080", want: -1},
+		{host: "google.com", want: -1},
+	}
+
+	r, err := newRouter(rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			want := r.fallback
+			if tt.want >= 0 {
+				want = r.rules[tt.want]
+			}
+
+			if got := r.match(tt.host); got != want {
+				t.Fatalf("want rule %d %+v, got %+v", tt.want, want, got)
+			}
+		})
+	}
+}
+
+func TestRouterFirstMatchWins(t *testing.T) {
+	r, err := newRouter([]RoutingRule{
+		{Suffix: ".ton", Action: RouteRLDP},
+		{Suffix: "blocked.ton", Action: RouteBlock},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := r.match("blocked.ton"); got.Action != RouteRLDP {
+		t.Fatalf("want first rule, got %s", got.Action)
+	}
+}
+
+func TestNewRouter(t *testing.T) {
+	tests := []struct {
+		name         string
+		rules        []RoutingRule
+		wantErr      bool
+		needUpstream bool
+		hasUpstream  bool
+	}{
+		{name: "default rules", rules: DefaultRoutingRules()},
+		{name: "empty", rules: nil},
+		{name: "no suffix and regex", rules: []RoutingRule{{Action: RouteDirect}}, wantErr: true},
+		{name: "invalid regex", rules: []RoutingRule{{Regex: `(`, Action: RouteDirect}}, wantErr: true},
+		{name: "unknown action", rules: []RoutingRule{{Suffix: ".ton", Action: "tunnel"}}, wantErr: true},
+		{name: "invalid upstream url", rules: []RoutingRule{{Suffix: ".org", Action: RouteUpstream, Upstream: "http://[::1"}}, wantErr: true},
+		{name: "unsupported upstream scheme", rules: []RoutingRule{{Suffix: ".org", Action: RouteUpstream, Upstream: "htp://10.0.0.1:3128"}}, wantErr: true},
+		{name: "own upstream", rules: []RoutingRule{{Suffix: ".org", Action: RouteUpstream, Upstream: "socks5://10.0.0.1:1080"}}, hasUpstream: true},
+		{name: "global upstream", rules: []RoutingRule{{Suffix: ".org", Action: RouteUpstream}}, needUpstream: true, hasUpstream: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := newRouter(tt.rules)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("want error %v, got %v", tt.wantErr, err)
+			}
+			if err != nil {
+				return
+			}
+
+			if r.needUpstream != tt.needUpstream {
+				t.Fatalf("want upstream needed %v, got %v", tt.needUpstream, r.needUpstream)
+			}
+			if r.hasUpstream != tt.hasUpstream {
+				t.Fatalf("want upstream used %v, got %v", tt.hasUpstream, r.hasUpstream)
+			}
+			if r.fallback != directRule {
+				t.Fatalf("want direct fallback, got %s", r.fallback.Action)
+			}
+		})
+	}
+}
+
+func TestRuleUpstreamClient(t *testing.T) {
+	r, err := newRouter([]RoutingRule{{Suffix: ".org", Action: RouteUpstream, Upstream: "http://10.0.0.1:3128"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tr, ok := r.rules[0].client.Transport.(*http.Transport)
+	if !ok {
+		t.Fatalf("unexpected transport %T", r.rules[0].client.Transport)
+	}
+	// timeouts of default transport are kept
+	if tr.TLSHandshakeTimeout == 0 || tr.IdleConnTimeout == 0 || !tr.ForceAttemptHTTP2 {
+		t.Fatal("transport is not based on default one")
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "https://example.org/", nil)
+	u, err := tr.Proxy(req)
+	if err != nil || u == nil || u.Host != "10.0.0.1:3128" {
+		t.Fatalf("want request through 10.0.0.1:3128, got %v %v", u, err)
+	}
+}
+
+func TestWeb2Client(t *testing.T) {
+	r, err := newRouter([]RoutingRule{
+		{Suffix: "direct.org", Action: RouteDirect},
+		{Suffix: "own.org", Action: RouteUpstream, Upstream: "http://10.0.0.1:3128"},
+		{Suffix: "global.org", Action: RouteUpstream},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	web2, upstream := &http.Client{}, &http.Client{}
+	p := &proxy{router: r, web2: web2, upstream: upstream}
+
+	tests := []struct {
+		host     string
+		fallback *RoutingRule
+		want     *http.Client
+	}{
+		{host: "direct.org", want: web2},
+		{host: "other.org", want: web2},
+		{host: "own.org", want: r.rules[1].client},
+		{host: "global.org", want: upstream},
+		// direct rules stay direct when upstream is used for everything else
+		{host: "direct.org", fallback: upstreamRule, want: web2},
+		{host: "other.org", fallback: upstreamRule, want: upstream},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			r.fallback = directRule
+			if tt.fallback != nil {
+				r.fallback = tt.fallback
+			}
+
+			if got := p.web2Client(r.match(tt.host)); got != tt.want {
+				t.Fatal("unexpected client")
+			}
+		})
+	}
+}
+
+func TestLoadRoutingRules(t *testing.T) {
+	dir := t.TempDir()
+
+	valid := filepath.Join(dir, "rules.json")
+	if err := os.WriteFile(valid, []byte(`{"Rules":[{"Suffix":".ton","Action":"rldp"},{"Regex":"^x\\.org$","Action":"block"}]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	rules, err := LoadRoutingRules(valid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 2 || rules[0].Action != RouteRLDP || rules[1].Regex != `^x\.org$` {
+		t.Fatalf("unexpected rules %+v", rules)
+	}
+
+	invalid := filepath.Join(dir, "invalid.json")
+	if err = os.WriteFile(invalid, []byte(`{"Rules":[{"Suffix":".ton","Action":"unknown"}]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = LoadRoutingRules(invalid); err == nil {
+		t.Fatal("invalid rules accepted")
+	}
+}
+
+func TestHostType(t *testing.T) {
+	tests := []struct {
+		host string
+		want string
+	}{
+		{host: "foundation.ton", want: hostTypeTON},
+		{host: "foundation.ton:80", want: hostTypeTON},
+		{host: "user.t.me", want: hostTypeTON},
+		{host: "abc.adnl", want: hostTypeADNL},
+		{host: "abc.bag", want: hostTypeBag},
+		{host: "google.com", want: hostTypeWeb2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			if got := hostType(tt.host); got != tt.want {
+				t.Fatalf("want %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// DefaultShutdownTimeout - max time to wait for active transfers on stop, when it is not set in Options
+const DefaultShutdownTimeout = 15 * time.Second
+
+type shutdownStep struct {
+	name  string
+	close func()
+}
+
+// shutdownSteps - components of running proxy, closed in reverse order of start
+type shutdownSteps []shutdownStep
+
+func (s *shutdownSteps) add(name string, close func()) {
+	*s = append(*s, shutdownStep{name: name, close: close})
+}
+
+// close - closes all components, progress is reported when report is not nil
+func (s shutdownSteps) close(report func(State)) {
+	for i := len(s) - 1; i >= 0; i-- {
+		if report != nil {
+			report(State{
+				Type:  "loading",
+				State: "Stopping: closing " + s[i].name + "...",
+			})
+		}
+
+		log.Debug().Str("component", s[i].name).Msg("closing")
+		s[i].close()
+	}
+}
+
+// drain - stops accepting new requests and waits for active transfers, up to shutdown timeout,
+// then remaining connections are interrupted
+func (p *Proxy) drain(h *proxy, server *http.Server) {
+	timeout := p.opts.ShutdownTimeout
+	if timeout <= 0 {
+		timeout = DefaultShutdownTimeout
+	}
+
+	h.stopping.Store(true)
+
+	active := h.transport.ActiveTransfers()
+	log.Info().Int("transfers", active).Dur("timeout", timeout).Msg("Stopping proxy, waiting for active transfers...")
+	p.report(State{
+		Type:  "loading",
+		State: fmt.Sprintf("Stopping: waiting for %d active transfers...", active),
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	if server != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			// waits for handlers to complete, including ordinary http requests
+			if err := server.Shutdown(ctx); err != nil {
+				_ = server.Close()
+			}
+		}()
+	}
+
+	if err := h.transport.Drain(ctx); err != nil {
+		log.Warn().Int("transfers", h.transport.ActiveTransfers()).Msg("Shutdown timeout reached, interrupting active transfers")
+	}
+	wg.Wait()
+}
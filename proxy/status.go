@@ -0,0 +1,212 @@
+package proxy
+
+import (
+	"encoding/json"
+	"github.com/xssnick/tonutils-proxy/proxy/transport"
+	"html/template"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// StatusHost - requests to this host are served by proxy itself, with status page
+const StatusHost = "proxy.local"
+
+type TunnelStatus struct {
+	Enabled   bool
+	Ready     bool
+	Stopped   bool
+	Addr      string
+	Paid      string
+	UpdatedAt time.Time
+}
+
+type tunnelState struct {
+	status TunnelStatus
+	mx     sync.RWMutex
+}
+
+func (s *tunnelState) update(f func(st *TunnelStatus)) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	f(&s.status)
+	s.status.UpdatedAt = time.Now()
+}
+
+// inUse - true when traffic of ton sites goes through the tunnel
+func (s *tunnelState) inUse() bool {
+	st := s.get()
+	return st.Ready && !st.Stopped
+}
+
+// viaTunnel - true when request matched by rule goes through the tunnel
+func (p *proxy) viaTunnel(rule *RoutingRule) bool {
+	if !p.tunnel.inUse() {
+		return false
+	}
+	return rule.isTON() || (rule.Action == RouteDirect && p.web2Tunneled)
+}
+
+func (s *tunnelState) get() TunnelStatus {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+
+	return s.status
+}
+
+type Status struct {
+	Version   string
+	StartedAt time.Time
+	BlockHttp bool
+	Tunnel    TunnelStatus
+	Sites     []transport.SiteStatus
+	Bags      []transport.BagStatus
+	Clients   []ClientUsage `json:",omitempty"`
+}
+
+func isStatusHost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return host == StatusHost
+}
+
+func (p *proxy) getStatus() Status {
+	var clients []ClientUsage
+	if p.gateway != nil {
+		clients = p.gateway.getUsage()
+	}
+
+	return Status{
+		Version:   p.version,
+		StartedAt: p.startedAt,
+		BlockHttp: p.blockHttp.Load(),
+		Tunnel:    p.tunnel.get(),
+		Sites:     p.transport.GetSitesStatus(),
+		Bags:      p.transport.GetBagsStatus(),
+		Clients:   clients,
+	}
+}
+
+func (p *proxy) serveStatus(wr http.ResponseWriter, req *http.Request) {
+	wr.Header().Set("Cache-Control", "no-store")
+
+	if strings.HasPrefix(req.URL.Path, "/api/") {
+		p.serveAdminAPI(wr, req)
+		return
+	}
+
+	switch req.URL.Path {
+	case "/", "/index.html":
+		wr.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := statusPage.Execute(wr, p.getStatus()); err != nil {
+			http.Error(wr, err.Error(), http.StatusInternalServerError)
+		}
+	case "/status.json":
+		wr.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(wr).Encode(p.getStatus())
+	default:
+		http.NotFound(wr, req)
+	}
+}
+
+var statusPage = template.Must(template.New("status").Funcs(template.FuncMap{
+	"ago": func(t time.Time) string {
+		if t.IsZero() || t.Unix() <= 0 {
+			return "never"
+		}
+		return time.Since(t).Round(time.Second).String() + " ago"
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="5">
+<title>Tonutils Proxy Status</title>
+<style>
+body { font-family: sans-serif; background: #232328; color: #e6e6e6; margin: 24px; }
+table { border-collapse: collapse; width: 100%; margin-bottom: 24px; }
+th, td { text-align: left; padding: 6px 10px; border-bottom: 1px solid #3a3a40; font-size: 14px; }
+th { color: #9a9aa0; font-weight: normal; }
+.healthy { color: #4caf50; } .degraded { color: #ffb300; } .dead { color: #f44336; } .connecting { color: #29b6f6; }
+.muted { color: #9a9aa0; }
+</style>
+</head>
+<body>
+<h2>Tonutils Proxy</h2>
+<p class="muted">Version {{.Version}}, started {{ago .StartedAt}}{{if .BlockHttp}}, ordinary HTTP is blocked{{end}}</p>
+
+<h3>Tunnel</h3>
+{{if .Tunnel.Enabled}}
+<p>{{if .Tunnel.Stopped}}Stopped{{else if .Tunnel.Ready}}Active, exit address {{.Tunnel.Addr}}{{else}}Preparing...{{end}}{{if .Tunnel.Paid}}, paid {{.Tunnel.Paid}} TON{{end}}
+<span class="muted">(updated {{ago .Tunnel.UpdatedAt}})</span></p>
+{{else}}
+<p class="muted">Not used</p>
+{{end}}
+
+<h3>Sites</h3>
+{{if .Sites}}
+<table>
+<tr><th>Host</th><th>Type</th><th>State</th><th>Address</th><th>Connections</th><th>In flight</th><th>Ping</th><th>Last success</th><th>Last used</th><th>Last error</th></tr>
+{{range .Sites}}
+<tr>
+<td>{{.Host}}</td>
+<td>{{.Type}}</td>
+<td class="{{.State}}">{{.State}}{{if .Failures}} ({{.Failures}} fails){{end}}{{if .PingFailures}} ({{.PingFailures}} pings lost){{end}}</td>
+<td>{{.Addr}}{{if gt (len .Addresses) 1}} <span class="muted">({{len .Addresses}} known)</span>{{end}}</td>
+<td>{{.Connections}}</td>
+<td>{{.InFlight}}</td>
+<td>{{if .Ping}}{{.Ping}}{{end}}</td>
+<td>{{ago .LastSuccess}}</td>
+<td>{{ago .LastUsed}}</td>
+<td class="muted">{{.LastError}}</td>
+</tr>
+{{end}}
+</table>
+{{else}}
+<p class="muted">No active sites</p>
+{{end}}
+
+<h3>Bags</h3>
+{{if .Bags}}
+<table>
+<tr><th>Host</th><th>Bag ID</th><th>Description</th><th>Size</th><th>Pieces fetched</th><th>Bytes fetched</th><th>Peers</th></tr>
+{{range .Bags}}
+<tr>
+<td>{{.Host}}</td>
+<td class="muted">{{.BagID}}</td>
+<td>{{.Description}}</td>
+<td>{{.Size}}</td>
+<td>{{.PiecesDownloaded}} of {{.PiecesTotal}}</td>
+<td>{{.BytesDownloaded}}</td>
+<td>{{.Peers}}</td>
+</tr>
+{{end}}
+</table>
+{{else}}
+<p class="muted">No active bags</p>
+{{end}}
+
+{{if .Clients}}
+<h3>Clients</h3>
+<table>
+<tr><th>Client</th><th>Active</th><th>Requests</th><th>Rejected</th><th>Bytes</th><th>Tunnel bytes</th><th>Quota reset</th></tr>
+{{range .Clients}}
+<tr>
+<td>{{.Client}}</td>
+<td>{{.Active}}</td>
+<td>{{.Requests}}</td>
+<td>{{.Rejected}}</td>
+<td>{{.Bytes}}</td>
+<td>{{.TunnelBytes}}</td>
+<td class="muted">{{.QuotaResetsAt.Format "2006-01-02 15:04"}}</td>
+</tr>
+{{end}}
+</table>
+{{end}}
+</body>
+</html>
+`))
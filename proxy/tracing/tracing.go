@@ -0,0 +1,106 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"os"
+)
+
+const serviceName = "tonutils-proxy"
+
+type Config struct {
+	// Endpoint - OTLP/HTTP collector address, like 127.0.0.1:4318
+	Endpoint string
+	// Insecure - use plain http to connect to collector
+	Insecure bool
+	// File - path to write spans to as JSON, used when no endpoint is set
+	File string
+	// SampleRatio - part of requests to trace, from 0 to 1, all are traced when 0
+	SampleRatio float64
+}
+
+// Tracer - returns tracer of the proxy, spans are dropped until Setup is called
+func Tracer(name string) trace.Tracer {
+	return otel.Tracer("github.com/xssnick/tonutils-proxy/" + name)
+}
+
+// Setup - configures global trace exporter, returned function flushes and stops it
+func Setup(ctx context.Context, cfg Config, version string) (func(context.Context) error, error) {
+	var exporter sdktrace.SpanExporter
+	var file *os.File
+
+	switch {
+	case cfg.Endpoint != "":
+		opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(cfg.Endpoint)}
+		if cfg.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+
+		exp, err := otlptracehttp.New(ctx, opts...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to init otlp exporter: %w", err)
+		}
+		exporter = exp
+	case cfg.File != "":
+		var err error
+		file, err = os.OpenFile(cfg.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open traces file: %w", err)
+		}
+
+		exp, err := stdouttrace.New(stdouttrace.WithWriter(file))
+		if err != nil {
+			_ = file.Close()
+			return nil, fmt.Errorf("failed to init file exporter: %w", err)
+		}
+		exporter = exp
+	default:
+		return nil, fmt.Errorf("endpoint or file should be set for tracing")
+	}
+
+	sampler := sdktrace.AlwaysSample()
+	if cfg.SampleRatio > 0 && cfg.SampleRatio < 1 {
+		sampler = sdktrace.TraceIDRatioBased(cfg.SampleRatio)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sampler)),
+		sdktrace.WithResource(resource.NewSchemaless(
+			semconv.ServiceName(serviceName),
+			semconv.ServiceVersion(version),
+		)),
+	)
+	otel.SetTracerProvider(provider)
+
+	return func(ctx context.Context) error {
+		err := provider.Shutdown(ctx)
+		if file != nil {
+			_ = file.Close()
+		}
+		return err
+	}, nil
+}
+
+// End - records error if any and ends span
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Host - attribute with requested site
+func Host(host string) attribute.KeyValue {
+	return attribute.String("proxy.host", host)
+}
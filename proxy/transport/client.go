@@ -13,7 +13,11 @@ import (
 	"github.com/xssnick/tonutils-go/adnl/rldp"
 	"github.com/xssnick/tonutils-go/tl"
 	"github.com/xssnick/tonutils-go/ton/dns"
+	"github.com/xssnick/tonutils-proxy/proxy/metrics"
+	"github.com/xssnick/tonutils-proxy/proxy/tracing"
 	"github.com/xssnick/tonutils-storage/storage"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"io"
 	"net/http"
 	"reflect"
@@ -26,6 +30,10 @@ import (
 
 const _ChunkSize = 1 << 17
 const _RLDPMaxAnswerSize = 2*_ChunkSize + 1024
+const _PrepareTimeout = 30 * time.Second
+const _PrepareAttempts = 3
+
+var tracer = tracing.Tracer("transport")
 
 type DHT interface {
 	StoreAddress(ctx context.Context, addresses address.List, ttl time.Duration, ownerKey ed25519.PrivateKey, copies int) (int, []byte, error)
@@ -61,6 +69,9 @@ type ADNL interface {
 type bagInfo struct {
 	torrent    *storage.Torrent
 	downloader storage.TorrentDownloader
+
+	piecesDownloaded uint64
+	bytesDownloaded  uint64
 }
 
 var newRLDP = func(a ADNL) RLDP {
@@ -72,14 +83,31 @@ type siteInfo struct {
 
 	LastUsed    int64
 	LastSuccess int64
+	health      siteHealth
+	preparing   *prepareCall
 	mx          sync.RWMutex
 }
 
-type rldpInfo struct {
-	ActiveClient RLDP
+type prepareCall struct {
+	done chan struct{}
+	err  error
+}
 
-	ID   ed25519.PublicKey
-	Addr string
+type rldpInfo struct {
+	// Clients - pool of connections, slot index matches gateway index
+	Clients   []*rldpConn
+	slotFreed chan struct{}
+
+	// dialing - slots reserved for connections being opened, index matches Clients
+	dialing []bool
+	// dialErr - last error of opening additional connection, new attempts are made after dialAfter
+	dialErr   error
+	dialFails int
+	dialAfter time.Time
+
+	ID        ed25519.PublicKey
+	Addr      string
+	Addresses []string
 }
 
 type Transport struct {
@@ -87,28 +115,34 @@ type Transport struct {
 	resolver         Resolver
 	storageConnector storage.NetConnector
 	store            *VirtualStorage
-	gate             *adnl.Gateway
+	gates            []*adnl.Gateway
 
 	activeSites map[string]*siteInfo
+	retryBudget *retryBudget
 
 	activeRequests map[string]*payloadStream
+	transfers      transfers
 	globalCtx      context.Context
 	stop           func()
 	mx             sync.RWMutex
 }
 
-func NewTransport(gate *adnl.Gateway, dht DHT, resolver Resolver, storeConn storage.NetConnector, store *VirtualStorage) *Transport {
+// NewTransport - creates transport, each of gates is used for its own connection to the site,
+// so number of gates defines max number of parallel connections per site.
+func NewTransport(gates []*adnl.Gateway, dht DHT, resolver Resolver, storeConn storage.NetConnector, store *VirtualStorage) *Transport {
 	t := &Transport{
-		gate:             gate,
+		gates:            gates,
 		dht:              dht,
 		resolver:         resolver,
 		storageConnector: storeConn,
 		store:            store,
 		activeRequests:   map[string]*payloadStream{},
 		activeSites:      map[string]*siteInfo{},
+		retryBudget:      newRetryBudget(),
 	}
 	t.globalCtx, t.stop = context.WithCancel(context.Background())
 	go t.cleaner()
+	go t.healthChecker()
 	return t
 }
 
@@ -124,15 +158,25 @@ func (t *Transport) cleaner() {
 		case <-time.After(3 * time.Second):
 		}
 
-		sites := make(map[string]*siteInfo, len(t.activeSites))
 		t.mx.RLock()
+		sites := make(map[string]*siteInfo, len(t.activeSites))
 		for s, info := range t.activeSites {
 			sites[s] = info
 		}
 		t.mx.RUnlock()
 
+		var rldpSites, bagSites float64
 		now := time.Now().Unix()
 		for s, info := range sites {
+			info.mx.RLock()
+			switch info.Actor.(type) {
+			case *rldpInfo:
+				rldpSites++
+			case *bagInfo:
+				bagSites++
+			}
+			info.mx.RUnlock()
+
 			if info.mx.TryLock() {
 				// stop bags that was not used for > 5 min
 				if atomic.LoadInt64(&info.LastUsed)+300 < now {
@@ -152,11 +196,13 @@ func (t *Transport) cleaner() {
 				info.mx.Unlock()
 			}
 		}
+		metrics.ActiveSites.WithLabelValues("rldp").Set(rldpSites)
+		metrics.ActiveSites.WithLabelValues("bag").Set(bagSites)
 	}
 }
 
-func (t *Transport) connectRLDP(key ed25519.PublicKey, addr, host string) (RLDP, error) {
-	a, err := t.gate.RegisterClient(addr, key)
+func (t *Transport) connectRLDP(slot int, key ed25519.PublicKey, addr, host string) (RLDP, error) {
+	a, err := t.gates[slot].RegisterClient(addr, key)
 	if err != nil {
 		return nil, fmt.Errorf("failed to init adnl for rldp connection %s, err: %w", addr, err)
 	}
@@ -178,20 +224,37 @@ func (t *Transport) removeRLDP(rl RLDP, host string) func() {
 			return
 		}
 
-		r.mx.Lock()
-		defer r.mx.Unlock()
+		r.dropClient(rl, false)
+	}
+}
 
-		if act, ok := r.Actor.(*rldpInfo); ok {
-			act.destroyClient(rl)
+// dropClient - closes rldp client and removes it from the site pool,
+// when nextAddr is true and it was the last client, the next known address of the site will be used for reconnect
+func (s *siteInfo) dropClient(rl RLDP, nextAddr bool) {
+	s.mx.Lock()
+	if act, ok := s.Actor.(*rldpInfo); ok {
+		for i, c := range act.Clients {
+			if c != nil && c.client == rl {
+				act.Clients[i] = nil
+				if nextAddr && !act.hasClients() {
+					act.switchAddress()
+				}
+				break
+			}
 		}
 	}
-}
+	s.mx.Unlock()
 
-func (r *rldpInfo) destroyClient(rl RLDP) {
+	// close outside of lock, because it triggers disconnect handler which takes it too
 	rl.Close()
+}
 
-	if r.ActiveClient == rl {
-		r.ActiveClient = nil
+func (r *rldpInfo) switchAddress() {
+	for i, addr := range r.Addresses {
+		if addr == r.Addr {
+			r.Addr = r.Addresses[(i+1)%len(r.Addresses)]
+			return
+		}
 	}
 }
 
@@ -218,6 +281,7 @@ func (t *Transport) getRLDPQueryHandler(r RLDP) func(transferId []byte, query *r
 			if err != nil {
 				return fmt.Errorf("failed to send answer: %w", err)
 			}
+			metrics.RLDPBytes.WithLabelValues("out").Add(float64(len(part.Data)))
 
 			if part.IsLast {
 				t.mx.Lock()
@@ -259,51 +323,242 @@ func handleGetPart(req GetNextPayloadPart, stream *payloadStream) (*PayloadPart,
 	}, nil
 }
 
-func (s *siteInfo) prepare(t *Transport, request *http.Request) (err error) {
-	select {
-	case <-t.globalCtx.Done():
-		return t.globalCtx.Err()
-	default:
+// readyActor - returns rldp info or bag of the site when it can be used without preparation,
+// must be called under read lock
+func (s *siteInfo) readyActor() any {
+	if s.Actor == nil || atomic.LoadInt64(&s.LastSuccess)+90 < time.Now().Unix() || s.health.needReResolve() {
+		return nil
 	}
 
-	host := request.Host
-	if host == "" {
-		host = request.URL.Host
+	switch act := s.Actor.(type) {
+	case *bagInfo:
+		atomic.StoreInt64(&s.LastUsed, time.Now().Unix())
+		return act
+	case *rldpInfo:
+		if !act.hasClients() {
+			return nil
+		}
+
+		now := time.Now().Unix()
+		if last := atomic.LoadInt64(&s.LastUsed); last+30 < now {
+			// only one of concurrent requests should reinit
+			if atomic.CompareAndSwapInt64(&s.LastUsed, last, now) {
+				for _, c := range act.Clients {
+					if c != nil {
+						c.client.GetADNL().(adnl.Peer).Reinit()
+					}
+				}
+			}
+		} else {
+			atomic.StoreInt64(&s.LastUsed, now)
+		}
+		return act
+	}
+	return nil
+}
+
+// getActor - returns rldp info or bag of the site, preparing it when needed.
+// Concurrent requests to the same site share a single preparation.
+func (s *siteInfo) getActor(ctx context.Context, t *Transport, host string) (any, error) {
+	for i := 0; ; i++ {
+		s.mx.RLock()
+		actor := s.readyActor()
+		s.mx.RUnlock()
+		if actor != nil {
+			return actor, nil
+		}
+
+		if i >= _PrepareAttempts {
+			return nil, fmt.Errorf("site was disconnected right after preparation")
+		}
+
+		s.mx.Lock()
+		call := s.preparing
+		if call == nil {
+			call = &prepareCall{done: make(chan struct{})}
+			s.preparing = call
+			go s.runPrepare(t, host, call, trace.SpanContextFromContext(ctx))
+		}
+		s.mx.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-t.globalCtx.Done():
+			return nil, t.globalCtx.Err()
+		case <-call.done:
+		}
+
+		if call.err != nil {
+			return nil, call.err
+		}
+	}
+}
+
+// runPrepare - parent is span of the request which started preparation, to see it in its trace
+func (s *siteInfo) runPrepare(t *Transport, host string, call *prepareCall, parent trace.SpanContext) {
+	// preparation is shared between requests, so it should not depend on context of any of them
+	ctx, cancel := context.WithTimeout(trace.ContextWithSpanContext(t.globalCtx, parent), _PrepareTimeout)
+	defer cancel()
+
+	ctx, span := tracer.Start(ctx, "prepare site", trace.WithAttributes(tracing.Host(host)))
+	tm := time.Now()
+	call.err = s.prepare(ctx, t, host)
+	tracing.End(span, call.err)
+	log.Debug().Str("host", host).Dur("took", time.Since(tm)).Err(call.err).Msg("prepare took")
+
+	s.mx.Lock()
+	s.preparing = nil
+	s.mx.Unlock()
+
+	close(call.done)
+}
+
+func (s *siteInfo) prepare(ctx context.Context, t *Transport, host string) (err error) {
+	for attempt := 0; attempt < _PrepareAttempts; attempt++ {
+		if attempt > 0 {
+			// first attempt fails fast when site is in backoff, next ones wait for it
+			if left := s.health.waitLeft(); left > 0 {
+				select {
+				case <-ctx.Done():
+					return err
+				case <-time.After(left):
+				}
+			}
+		}
+
+		err = s.prepareOnce(ctx, t, host)
+		if err == nil {
+			return nil
+		}
+
+		if ctx.Err() != nil || errors.Is(err, ErrSiteBackoff) || errors.Is(err, dns.ErrNoSuchRecord) {
+			return err
+		}
+		log.Debug().Err(err).Str("host", host).Int("attempt", attempt+1).Msg("failed to prepare site")
+	}
+	return err
+}
+
+func (s *siteInfo) prepareOnce(ctx context.Context, t *Transport, host string) error {
+	var toClose []RLDP
+	s.mx.Lock()
+	if act, ok := s.Actor.(*rldpInfo); ok && s.health.takeReResolve() {
+		log.Info().Str("host", host).Msg("re-resolving site because of repeated errors")
+		toClose = act.takeClients()
+		s.Actor = nil
+	}
+
+	actor := s.Actor
+	if atomic.LoadInt64(&s.LastSuccess)+90 < time.Now().Unix() {
+		actor = nil
+	}
+	s.mx.Unlock()
+
+	for _, c := range toClose {
+		c.Close()
 	}
 
-	if s.Actor == nil || atomic.LoadInt64(&s.LastSuccess)+90 < time.Now().Unix() {
-		s.Actor, err = t.resolve(request.Context(), host)
+	if actor == nil {
+		if left := s.health.waitLeft(); left > 0 {
+			return fmt.Errorf("%w, next attempt in %s", ErrSiteBackoff, left.Round(time.Millisecond))
+		}
+
+		s.health.connecting()
+		actor, err := t.resolve(ctx, host)
 		if err != nil {
+			if ctx.Err() == nil || errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				s.health.failure(err)
+			}
 			return err
 		}
+		s.health.success()
+
+		s.mx.Lock()
+		s.Actor = actor
 		// update success after resolve to not re-resolve too soon
 		atomic.StoreInt64(&s.LastSuccess, time.Now().Unix())
 		atomic.StoreInt64(&s.LastUsed, time.Now().Unix())
+		s.mx.Unlock()
+		return nil
 	}
 
-	switch act := s.Actor.(type) {
-	case *bagInfo:
-		atomic.StoreInt64(&s.LastUsed, time.Now().Unix())
-	case *rldpInfo:
-		if act.ActiveClient != nil && atomic.LoadInt64(&s.LastUsed)+30 < time.Now().Unix() {
-			act.ActiveClient.GetADNL().(adnl.Peer).Reinit()
-			atomic.StoreInt64(&s.LastUsed, time.Now().Unix())
+	act, ok := actor.(*rldpInfo)
+	if !ok {
+		return nil
+	}
+
+	s.mx.RLock()
+	connected := act.hasClients()
+	addr := act.Addr
+	s.mx.RUnlock()
+
+	if !connected {
+		if left := s.health.waitLeft(); left > 0 {
+			return fmt.Errorf("%w, next attempt in %s", ErrSiteBackoff, left.Round(time.Millisecond))
 		}
 
-		if act.ActiveClient == nil {
-			act.ActiveClient, err = t.connectRLDP(act.ID, act.Addr, host)
-			if err != nil {
-				// resolve again
+		s.health.connecting()
+		_, span := tracer.Start(ctx, "rldp connect", trace.WithAttributes(tracing.Host(host), attribute.String("address", addr)))
+		client, err := t.connectRLDP(0, act.ID, addr, host)
+		tracing.End(span, err)
+		if err != nil {
+			s.health.failure(err)
+
+			// resolve again on next attempt
+			s.mx.Lock()
+			if s.Actor == act {
 				s.Actor = nil
-				return s.prepare(t, request)
 			}
-			atomic.StoreInt64(&s.LastUsed, time.Now().Unix())
+			s.mx.Unlock()
+			return err
 		}
+
+		s.mx.Lock()
+		act.Clients[0] = &rldpConn{client: client}
+		s.mx.Unlock()
+		atomic.StoreInt64(&s.LastUsed, time.Now().Unix())
 	}
 	return nil
 }
 
-func (t *Transport) RoundTrip(request *http.Request) (_ *http.Response, err error) {
+// SiteRoute - returns how site is served: rldp or storage, empty if site is not resolved
+func (t *Transport) SiteRoute(host string) string {
+	t.mx.RLock()
+	site := t.activeSites[host]
+	t.mx.RUnlock()
+
+	if site == nil {
+		return ""
+	}
+
+	site.mx.RLock()
+	defer site.mx.RUnlock()
+
+	switch site.Actor.(type) {
+	case *rldpInfo:
+		return "rldp"
+	case *bagInfo:
+		return "storage"
+	}
+	return ""
+}
+
+func (t *Transport) RoundTrip(request *http.Request) (*http.Response, error) {
+	if !t.transfers.begin() {
+		return nil, ErrStopping
+	}
+
+	resp, err := t.roundTrip(request)
+	if err != nil || resp.Body == nil {
+		t.transfers.end()
+		return resp, err
+	}
+	resp.Body = &trackedBody{ReadCloser: resp.Body, end: t.transfers.end}
+	return resp, nil
+}
+
+func (t *Transport) roundTrip(request *http.Request) (_ *http.Response, err error) {
 	host := request.Host
 	if host == "" {
 		host = request.URL.Host
@@ -319,45 +574,46 @@ func (t *Transport) RoundTrip(request *http.Request) (_ *http.Response, err erro
 	}
 	t.mx.Unlock()
 
-	var rldpClient RLDP
-	var torrent *bagInfo
-
-	tm := time.Now()
-	site.mx.Lock()
-	err = site.prepare(t, request)
-	log.Info().Str("host", host).Dur("took", time.Since(tm)).Msg("prepare took")
-
+	actor, err := site.getActor(request.Context(), t, host)
 	if err != nil {
-		site.mx.Unlock()
 		return nil, fmt.Errorf("failed to connect to site: %w", err)
 	}
 
-	switch act := site.Actor.(type) {
-	case *rldpInfo:
-		rldpClient = act.ActiveClient
-	case *bagInfo:
-		torrent = act
-	}
-	site.mx.Unlock()
+	rldpSite, _ := actor.(*rldpInfo)
+	torrent, _ := actor.(*bagInfo)
 
-	if rldpClient != nil {
-		resp, err := t.doRldpHttp(rldpClient, host, request)
+	if rldpSite != nil {
+		resp, err := t.doRldpHttpWithRetry(site, rldpSite, host, request)
 		if err != nil {
 			return nil, fmt.Errorf("failed to request rldp-http site: %w", err)
 		}
+		site.health.success()
 		atomic.StoreInt64(&site.LastSuccess, time.Now().Unix())
 		return resp, nil
 	}
 
 	resp, err := t.doTorrent(torrent, request, site)
 	if err != nil {
+		if request.Context().Err() == nil {
+			site.health.failure(err)
+		}
 		return nil, fmt.Errorf("failed to request file from storage: %w", err)
 	}
+	site.health.success()
 	atomic.StoreInt64(&site.LastSuccess, time.Now().Unix())
 	return resp, nil
 }
 
 func (t *Transport) doTorrent(bag *bagInfo, request *http.Request, si *siteInfo) (*http.Response, error) {
+	ctx, span := tracer.Start(request.Context(), "storage request", trace.WithAttributes(
+		tracing.Host(request.Host), attribute.String("path", request.URL.Path)))
+	streaming := false
+	defer func() {
+		if !streaming {
+			span.End()
+		}
+	}()
+
 	fileName := request.URL.Path
 	if strings.HasPrefix(fileName, "/") {
 		fileName = fileName[1:]
@@ -476,10 +732,12 @@ func (t *Transport) doTorrent(bag *bagInfo, request *http.Request, si *siteInfo)
 		stream := newDataStreamer()
 		httpResp.Body = stream
 
+		streaming = true
 		go func() {
 			defer fetch.Stop()
 
-			err := t.proxyOrdered(request.Context(), fileInfo, piecesMap, fetch, stream, si, bag.torrent.Info.PieceSize, from, to)
+			err := t.proxyOrdered(ctx, fileInfo, piecesMap, fetch, stream, si, bag, bag.torrent.Info.PieceSize, from, to)
+			tracing.End(span, err)
 			if err != nil {
 				_ = stream.Close()
 				if !errors.Is(err, context.Canceled) {
@@ -494,9 +752,21 @@ func (t *Transport) doTorrent(bag *bagInfo, request *http.Request, si *siteInfo)
 	return httpResp, nil
 }
 
-func (t *Transport) doRldpHttp(client RLDP, host string, request *http.Request) (*http.Response, error) {
+// doRldpHttp - executes request over rldp, onDone is called when request and response payload are fully processed
+func (t *Transport) doRldpHttp(client RLDP, host string, request *http.Request, onDone func()) (_ *http.Response, err error) {
+	ctx, span := tracer.Start(request.Context(), "rldp http", trace.WithAttributes(
+		tracing.Host(host), attribute.String("method", request.Method), attribute.String("path", request.URL.Path)))
+
+	finished := true
+	defer func() {
+		if finished {
+			tracing.End(span, err)
+			onDone()
+		}
+	}()
+
 	qid := make([]byte, 32)
-	_, err := rand.Read(qid)
+	_, err = rand.Read(qid)
 	if err != nil {
 		return nil, err
 	}
@@ -538,6 +808,7 @@ func (t *Transport) doRldpHttp(client RLDP, host string, request *http.Request)
 			defer request.Body.Close()
 
 			var n int
+			var err error
 			for {
 				buf := make([]byte, 4096)
 				n, err = request.Body.Read(buf)
@@ -576,9 +847,11 @@ func (t *Transport) doRldpHttp(client RLDP, host string, request *http.Request)
 	}
 
 	var res Response
-	err = client.DoQuery(request.Context(), _RLDPMaxAnswerSize, req, &res)
+	queryCtx, querySpan := tracer.Start(ctx, "rldp query")
+	err = client.DoQuery(queryCtx, _RLDPMaxAnswerSize, req, &res)
+	tracing.End(querySpan, err)
 	if err != nil {
-		return nil, fmt.Errorf("failed to query http over rldp: %w", err)
+		return nil, fmt.Errorf("failed to query http over rldp: %w", &connError{err: err})
 	}
 
 	httpResp := &http.Response{
@@ -614,15 +887,25 @@ func (t *Transport) doRldpHttp(client RLDP, host string, request *http.Request)
 			dr.buf = make([]byte, 0, httpResp.ContentLength)
 		}
 
+		finished = false
 		go func() {
+			var err error
+			defer func() {
+				tracing.End(span, err)
+				onDone()
+			}()
+
 			seqno := int32(0)
 			for withPayload {
 				var part PayloadPart
-				err := client.DoQuery(request.Context(), _RLDPMaxAnswerSize*1000, GetNextPayloadPart{
+				partCtx, partSpan := tracer.Start(ctx, "payload part", trace.WithAttributes(attribute.Int("seqno", int(seqno))))
+				err = client.DoQuery(partCtx, _RLDPMaxAnswerSize*1000, GetNextPayloadPart{
 					ID:           qid,
 					Seqno:        seqno,
 					MaxChunkSize: _ChunkSize * 100,
 				}, &part)
+				partSpan.SetAttributes(attribute.Int("bytes", len(part.Data)))
+				tracing.End(partSpan, err)
 				if err != nil {
 					_ = dr.Close()
 					return
@@ -632,6 +915,8 @@ func (t *Transport) doRldpHttp(client RLDP, host string, request *http.Request)
 					httpResp.Trailer[tr.Name] = []string{tr.Value}
 				}
 
+				metrics.RLDPBytes.WithLabelValues("in").Add(float64(len(part.Data)))
+
 				withPayload = !part.IsLast
 				_, err = dr.Write(part.Data)
 				if err != nil {
@@ -654,6 +939,11 @@ func (t *Transport) doRldpHttp(client RLDP, host string, request *http.Request)
 }
 
 func (t *Transport) resolve(ctx context.Context, host string) (_ any, err error) {
+	ctx, span := tracer.Start(ctx, "resolve", trace.WithAttributes(tracing.Host(host)))
+	defer func() {
+		tracing.End(span, err)
+	}()
+
 	var id []byte
 	var inStorage bool
 	if strings.HasSuffix(host, ".adnl") {
@@ -669,7 +959,8 @@ func (t *Transport) resolve(ctx context.Context, host string) (_ any, err error)
 		inStorage = true
 	} else {
 		tm := time.Now()
-		lookupCtx, stopLookup := context.WithCancel(ctx)
+		dnsCtx, dnsSpan := tracer.Start(ctx, "dns resolve")
+		lookupCtx, stopLookup := context.WithCancel(dnsCtx)
 		ch := make(chan *dns.Domain, 3)
 		for i := 0; i < 3; i++ { // do parallel lookup on diff nodes to speedup
 			go func(i int) {
@@ -702,12 +993,18 @@ func (t *Transport) resolve(ctx context.Context, host string) (_ any, err error)
 		case domain = <-ch:
 			stopLookup()
 			if domain == nil {
-				return nil, fmt.Errorf("domain %s resolve err: %w", host, dns.ErrNoSuchRecord)
+				err = fmt.Errorf("domain %s resolve err: %w", host, dns.ErrNoSuchRecord)
+				tracing.End(dnsSpan, err)
+				return nil, err
 			}
 		case <-lookupCtx.Done():
 			stopLookup()
-			return nil, fmt.Errorf("failed to resolve domain %s in ton dns", host)
+			err = fmt.Errorf("failed to resolve domain %s in ton dns", host)
+			tracing.End(dnsSpan, err)
+			return nil, err
 		}
+		dnsSpan.End()
+		metrics.DNSResolveDuration.Observe(time.Since(tm).Seconds())
 		log.Info().Str("domain", host).Dur("duration", time.Since(tm)).Msg("resolve domain took")
 
 		id, inStorage = domain.GetSiteRecord()
@@ -716,6 +1013,11 @@ func (t *Transport) resolve(ctx context.Context, host string) (_ any, err error)
 	if inStorage {
 		log.Info().Str("bag_id", hex.EncodeToString(id)).Str("host", host).Msg("searching for bag id")
 
+		_, bagSpan := tracer.Start(ctx, "bag start", trace.WithAttributes(attribute.String("bag_id", hex.EncodeToString(id))))
+		defer func() {
+			tracing.End(bagSpan, err)
+		}()
+
 		torrent := storage.NewTorrent("", t.store, t.storageConnector)
 		torrent.BagID = id
 
@@ -740,7 +1042,11 @@ func (t *Transport) resolve(ctx context.Context, host string) (_ any, err error)
 
 	log.Info().Str("host", host).Str("node", hex.EncodeToString(id)).Msg("resolving ton site address")
 
-	addresses, pubKey, err := t.dht.FindAddresses(ctx, id)
+	tm := time.Now()
+	dhtCtx, dhtSpan := tracer.Start(ctx, "dht find addresses", trace.WithAttributes(attribute.String("node", hex.EncodeToString(id))))
+	addresses, pubKey, err := t.dht.FindAddresses(dhtCtx, id)
+	tracing.End(dhtSpan, err)
+	metrics.DHTResolveDuration.Observe(time.Since(tm).Seconds())
 	if err != nil {
 		return nil, fmt.Errorf("failed to find address of %s (%s) in DHT, err: %w", host, hex.EncodeToString(id), err)
 	}
@@ -754,13 +1060,20 @@ func (t *Transport) resolve(ctx context.Context, host string) (_ any, err error)
 	var addr string
 	var client RLDP
 	var triedAddresses []string
+	var allAddresses []string
 	for _, v := range addresses.Addresses {
-		addr = fmt.Sprintf("%s:%d", v.IP.String(), v.Port)
+		allAddresses = append(allAddresses, fmt.Sprintf("%s:%d", v.IP.String(), v.Port))
+	}
+
+	for _, a := range allAddresses {
+		addr = a
 
 		log.Info().Str("host", host).Str("node", hex.EncodeToString(id)).Str("address", addr).Msg("connecting to ton site")
 
 		// find working rldp node addr
-		client, err = t.connectRLDP(pubKey, addr, host)
+		_, connSpan := tracer.Start(ctx, "rldp connect", trace.WithAttributes(attribute.String("address", addr)))
+		client, err = t.connectRLDP(0, pubKey, addr, host)
+		tracing.End(connSpan, err)
 		if err != nil {
 			log.Error().Err(err).Str("host", host).Str("node", hex.EncodeToString(id)).Str("address", addr).Msg("connection failed")
 
@@ -777,15 +1090,19 @@ func (t *Transport) resolve(ctx context.Context, host string) (_ any, err error)
 	log.Info().Str("host", host).Str("node", hex.EncodeToString(id)).Str("address", addr).Msg("connected to server")
 
 	info := &rldpInfo{
-		ActiveClient: client,
-		ID:           pubKey,
-		Addr:         addr,
+		Clients:   make([]*rldpConn, len(t.gates)),
+		slotFreed: make(chan struct{}, 1),
+		dialing:   make([]bool, len(t.gates)),
+		ID:        pubKey,
+		Addr:      addr,
+		Addresses: allAddresses,
 	}
+	info.Clients[0] = &rldpConn{client: client}
 	return info, nil
 }
 
 func (t *Transport) proxyOrdered(ctx context.Context, file *storage.FileInfo,
-	piecesMap map[uint32]bool, fetch *storage.PreFetcher, stream *dataStreamer, si *siteInfo,
+	piecesMap map[uint32]bool, fetch *storage.PreFetcher, stream *dataStreamer, si *siteInfo, bag *bagInfo,
 	pieceSz uint32, from, to uint64) error {
 	var err error
 	var currentPieceId uint32
@@ -816,10 +1133,16 @@ func (t *Transport) proxyOrdered(ctx context.Context, file *storage.FileInfo,
 
 				atomic.StoreInt64(&si.LastUsed, time.Now().Unix())
 
+				_, span := tracer.Start(ctx, "piece wait", trace.WithAttributes(attribute.Int64("piece", int64(piece))))
 				currentPiece, _, err = fetch.WaitGet(ctx, piece)
+				tracing.End(span, err)
 				if err != nil {
 					return fmt.Errorf("failed to download piece %d: %w", piece, err)
 				}
+				metrics.BagPieces.Inc()
+				metrics.BagBytes.Add(float64(len(currentPiece)))
+				atomic.AddUint64(&bag.piecesDownloaded, 1)
+				atomic.AddUint64(&bag.bytesDownloaded, uint64(len(currentPiece)))
 
 				currentPieceId = piece
 			}
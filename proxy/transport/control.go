@@ -0,0 +1,95 @@
+package transport
+
+import (
+	"encoding/hex"
+	"github.com/rs/zerolog/log"
+	"strings"
+)
+
+// DropSite - closes connections of the site and forgets its resolved address,
+// so the next request will resolve it again. Returns false if site is not active.
+func (t *Transport) DropSite(host string) bool {
+	t.mx.RLock()
+	site := t.activeSites[host]
+	t.mx.RUnlock()
+
+	if site == nil {
+		return false
+	}
+
+	t.resetSite(host, site)
+	return true
+}
+
+// FlushResolved - forgets resolved addresses of all sites and stops their bags,
+// everything will be resolved again using DNS and DHT on the next request
+func (t *Transport) FlushResolved() int {
+	t.mx.RLock()
+	sites := make(map[string]*siteInfo, len(t.activeSites))
+	for s, info := range t.activeSites {
+		sites[s] = info
+	}
+	t.mx.RUnlock()
+
+	for host, site := range sites {
+		t.resetSite(host, site)
+	}
+	return len(sites)
+}
+
+// StopBag - stops downloading of the bag, host could be site domain or bag id. Returns false if bag is not active.
+func (t *Transport) StopBag(hostOrBagID string) bool {
+	t.mx.RLock()
+	sites := make(map[string]*siteInfo, len(t.activeSites))
+	for s, info := range t.activeSites {
+		sites[s] = info
+	}
+	t.mx.RUnlock()
+
+	for host, site := range sites {
+		site.mx.RLock()
+		bag, ok := site.Actor.(*bagInfo)
+		site.mx.RUnlock()
+
+		if ok && (host == hostOrBagID || strings.EqualFold(hex.EncodeToString(bag.torrent.BagID), hostOrBagID)) {
+			t.resetSite(host, site)
+			return true
+		}
+	}
+	return false
+}
+
+func (t *Transport) resetSite(host string, site *siteInfo) {
+	var toClose []RLDP
+	var bag *bagInfo
+
+	site.mx.Lock()
+	switch act := site.Actor.(type) {
+	case *rldpInfo:
+		toClose = act.takeClients()
+	case *bagInfo:
+		bag = act
+	}
+	site.Actor = nil
+	site.health.reset()
+	site.mx.Unlock()
+
+	// close outside of lock, because it triggers disconnect handler which takes it too
+	for _, c := range toClose {
+		c.Close()
+	}
+
+	if bag != nil {
+		t.mx.Lock()
+		if t.activeSites[host] == site {
+			delete(t.activeSites, host)
+		}
+		t.mx.Unlock()
+
+		bag.downloader.Close()
+		bag.torrent.Stop()
+		log.Debug().Hex("bag_id", bag.torrent.BagID).Msg("stopped bag")
+	}
+
+	log.Info().Str("host", host).Msg("site connection dropped")
+}
@@ -0,0 +1,92 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+)
+
+// ErrStopping - transport is draining and doesn't accept new requests
+var ErrStopping = errors.New("transport is stopping")
+
+// transfers - requests in progress, each is counted until its response body is read till the end or closed
+type transfers struct {
+	count    int
+	stopping bool
+	idle     chan struct{}
+	mx       sync.Mutex
+}
+
+// begin - registers new transfer, false when transport is stopping
+func (t *transfers) begin() bool {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+
+	if t.stopping {
+		return false
+	}
+	t.count++
+	return true
+}
+
+func (t *transfers) end() {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+
+	t.count--
+	if t.count == 0 && t.idle != nil {
+		close(t.idle)
+		t.idle = nil
+	}
+}
+
+// trackedBody - ends transfer when body is read till the end or closed
+type trackedBody struct {
+	io.ReadCloser
+	end  func()
+	once sync.Once
+}
+
+func (b *trackedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil {
+		b.once.Do(b.end)
+	}
+	return n, err
+}
+
+func (b *trackedBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.end)
+	return err
+}
+
+// ActiveTransfers - number of requests in progress, including responses which body is not yet read
+func (t *Transport) ActiveTransfers() int {
+	t.transfers.mx.Lock()
+	defer t.transfers.mx.Unlock()
+	return t.transfers.count
+}
+
+// Drain - stops accepting new requests and waits until active transfers are completed or ctx is done
+func (t *Transport) Drain(ctx context.Context) error {
+	t.transfers.mx.Lock()
+	t.transfers.stopping = true
+	if t.transfers.count == 0 {
+		t.transfers.mx.Unlock()
+		return nil
+	}
+	if t.transfers.idle == nil {
+		t.transfers.idle = make(chan struct{})
+	}
+	idle := t.transfers.idle
+	t.transfers.mx.Unlock()
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
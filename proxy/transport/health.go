@@ -0,0 +1,353 @@
+package transport
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"github.com/xssnick/tonutils-go/adnl"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const _HealthReResolveAfter = 2
+const _HealthDeadAfter = 4
+const _HealthMinBackoff = 1 * time.Second
+const _HealthMaxBackoff = 60 * time.Second
+const _HealthPingInterval = 15 * time.Second
+const _HealthPingTimeout = 5 * time.Second
+
+// site is shown as degraded after this number of failed pings in a row, but it is not reconnected,
+// only failed requests lead to backoff and re-resolve
+const _HealthPingDegradedAfter = 2
+
+// sites which were not used for this number of seconds are not pinged
+const _HealthActiveWindow = 120
+
+var ErrSiteBackoff = errors.New("site is temporarily unavailable")
+
+type SiteState int32
+
+const (
+	SiteStateConnecting SiteState = iota
+	SiteStateHealthy
+	SiteStateDegraded
+	SiteStateDead
+)
+
+func (s SiteState) String() string {
+	switch s {
+	case SiteStateConnecting:
+		return "connecting"
+	case SiteStateHealthy:
+		return "healthy"
+	case SiteStateDegraded:
+		return "degraded"
+	case SiteStateDead:
+		return "dead"
+	}
+	return "unknown"
+}
+
+type siteHealth struct {
+	state       SiteState
+	failures    int
+	reResolve   bool
+	nextAttempt time.Time
+	lastError   string
+	lastPing    time.Duration
+
+	pingFailures int
+
+	mx sync.Mutex
+}
+
+func (h *siteHealth) success() {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+
+	h.state = SiteStateHealthy
+	h.failures = 0
+	h.reResolve = false
+	h.nextAttempt = time.Time{}
+}
+
+func (h *siteHealth) failure(err error) {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+
+	h.failures++
+	h.lastError = err.Error()
+
+	h.state = SiteStateDegraded
+	if h.failures >= _HealthDeadAfter {
+		h.state = SiteStateDead
+	}
+
+	if h.failures%_HealthReResolveAfter == 0 {
+		h.reResolve = true
+	}
+
+	backoff := _HealthMinBackoff << (h.failures - 1)
+	if backoff > _HealthMaxBackoff || backoff <= 0 {
+		backoff = _HealthMaxBackoff
+	}
+	h.nextAttempt = time.Now().Add(backoff)
+}
+
+func (h *siteHealth) reset() {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+
+	h.state = SiteStateConnecting
+	h.failures = 0
+	h.reResolve = false
+	h.nextAttempt = time.Time{}
+	h.lastError = ""
+	h.lastPing = 0
+	h.pingFailures = 0
+}
+
+func (h *siteHealth) connecting() {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+
+	if h.state != SiteStateDead {
+		h.state = SiteStateConnecting
+	}
+}
+
+// dead - too many requests failed in a row, so connections of the site are considered broken
+func (h *siteHealth) dead() bool {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+
+	return h.state == SiteStateDead
+}
+
+// waitLeft - returns time left until the next connection attempt is allowed
+func (h *siteHealth) waitLeft() time.Duration {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+
+	return time.Until(h.nextAttempt)
+}
+
+func (h *siteHealth) needReResolve() bool {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+
+	return h.reResolve
+}
+
+// takeReResolve - returns true once when site should be resolved again because of repeated errors
+func (h *siteHealth) takeReResolve() bool {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+
+	if h.reResolve {
+		h.reResolve = false
+		return true
+	}
+	return false
+}
+
+// pingResult - records result of health ping, it is counted separately from request failures,
+// so slow but working site is not torn down
+func (h *siteHealth) pingResult(d time.Duration, err error) {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+
+	if err != nil {
+		h.pingFailures++
+		h.lastError = err.Error()
+		if h.state == SiteStateHealthy && h.pingFailures >= _HealthPingDegradedAfter {
+			h.state = SiteStateDegraded
+		}
+		return
+	}
+
+	h.pingFailures = 0
+	h.lastPing = d
+	if h.state == SiteStateDegraded && h.failures == 0 {
+		h.state = SiteStateHealthy
+	}
+}
+
+type SiteStatus struct {
+	Host         string
+	Type         string
+	State        string
+	Failures     int
+	PingFailures int
+	LastError    string
+	Addr         string
+	Addresses    []string
+	Connections  int
+	InFlight     int
+	Ping         time.Duration
+	LastUsed     time.Time
+	LastSuccess  time.Time
+	RetryAt      time.Time
+}
+
+// GetSitesStatus - returns health information about all active sites, for diagnostics
+func (t *Transport) GetSitesStatus() []SiteStatus {
+	t.mx.RLock()
+	sites := make(map[string]*siteInfo, len(t.activeSites))
+	for s, info := range t.activeSites {
+		sites[s] = info
+	}
+	t.mx.RUnlock()
+
+	list := make([]SiteStatus, 0, len(sites))
+	for host, info := range sites {
+		st := SiteStatus{
+			Host:        host,
+			LastUsed:    time.Unix(atomic.LoadInt64(&info.LastUsed), 0),
+			LastSuccess: time.Unix(atomic.LoadInt64(&info.LastSuccess), 0),
+		}
+
+		info.health.mx.Lock()
+		st.State = info.health.state.String()
+		st.Failures = info.health.failures
+		st.PingFailures = info.health.pingFailures
+		st.LastError = info.health.lastError
+		st.Ping = info.health.lastPing
+		st.RetryAt = info.health.nextAttempt
+		info.health.mx.Unlock()
+
+		if info.mx.TryRLock() {
+			switch act := info.Actor.(type) {
+			case *rldpInfo:
+				st.Type = "rldp"
+				st.Addr = act.Addr
+				st.Addresses = append([]string{}, act.Addresses...)
+				st.Connections, st.InFlight = act.inFlight()
+			case *bagInfo:
+				st.Type = "bag"
+			}
+			info.mx.RUnlock()
+		}
+
+		list = append(list, st)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Host < list[j].Host
+	})
+	return list
+}
+
+type BagStatus struct {
+	Host             string
+	BagID            string
+	Description      string
+	Size             uint64
+	PiecesTotal      uint32
+	PiecesDownloaded uint64
+	BytesDownloaded  uint64
+	Peers            int
+}
+
+// GetBagsStatus - returns download information about active bags, for diagnostics
+func (t *Transport) GetBagsStatus() []BagStatus {
+	t.mx.RLock()
+	sites := make(map[string]*siteInfo, len(t.activeSites))
+	for s, info := range t.activeSites {
+		sites[s] = info
+	}
+	t.mx.RUnlock()
+
+	var list []BagStatus
+	for host, info := range sites {
+		info.mx.RLock()
+		bag, ok := info.Actor.(*bagInfo)
+		info.mx.RUnlock()
+		if !ok {
+			continue
+		}
+
+		st := BagStatus{
+			Host:             host,
+			BagID:            hex.EncodeToString(bag.torrent.BagID),
+			PiecesDownloaded: atomic.LoadUint64(&bag.piecesDownloaded),
+			BytesDownloaded:  atomic.LoadUint64(&bag.bytesDownloaded),
+			Peers:            len(bag.torrent.GetPeers()),
+		}
+		if bag.torrent.Info != nil {
+			st.PiecesTotal = bag.torrent.Info.PiecesNum()
+			st.Size = bag.torrent.Info.FileSize
+			st.Description = bag.torrent.Info.Description.Value
+		}
+		list = append(list, st)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Host < list[j].Host
+	})
+	return list
+}
+
+func (t *Transport) healthChecker() {
+	for {
+		select {
+		case <-t.globalCtx.Done():
+			return
+		case <-time.After(_HealthPingInterval):
+		}
+
+		t.mx.RLock()
+		sites := make(map[string]*siteInfo, len(t.activeSites))
+		for s, info := range t.activeSites {
+			sites[s] = info
+		}
+		t.mx.RUnlock()
+
+		now := time.Now().Unix()
+		for host, info := range sites {
+			if atomic.LoadInt64(&info.LastUsed)+_HealthActiveWindow < now {
+				continue
+			}
+
+			var client RLDP
+			info.mx.RLock()
+			if act, ok := info.Actor.(*rldpInfo); ok {
+				client = act.firstClient()
+			}
+			info.mx.RUnlock()
+
+			if client == nil {
+				continue
+			}
+
+			go t.pingSite(host, info, client)
+		}
+	}
+}
+
+func (t *Transport) pingSite(host string, info *siteInfo, client RLDP) {
+	peer, ok := client.GetADNL().(adnl.Peer)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(t.globalCtx, _HealthPingTimeout)
+	defer cancel()
+
+	took, err := peer.Ping(ctx)
+	if err != nil {
+		if t.globalCtx.Err() != nil {
+			return
+		}
+
+		log.Debug().Err(err).Str("host", host).Msg("site ping failed")
+		info.health.pingResult(0, fmt.Errorf("ping failed: %w", err))
+		return
+	}
+
+	info.health.pingResult(took, nil)
+}
@@ -0,0 +1,197 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// _RLDPMaxInFlight - max number of parallel requests over a single rldp connection,
+// when all connections of the site are busy, a new one is opened, until pool is full
+const _RLDPMaxInFlight = 6
+
+// when additional connection cannot be opened, next attempt is made after backoff,
+// requests are waiting for existing connections meanwhile
+const _RLDPDialMinBackoff = 500 * time.Millisecond
+const _RLDPDialMaxBackoff = 30 * time.Second
+
+var errNoConnections = errors.New("site has no active connections")
+
+type rldpConn struct {
+	client   RLDP
+	inFlight int32
+}
+
+// hasClients - must be called under site lock
+func (r *rldpInfo) hasClients() bool {
+	for _, c := range r.Clients {
+		if c != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// firstClient - must be called under site lock
+func (r *rldpInfo) firstClient() RLDP {
+	for _, c := range r.Clients {
+		if c != nil {
+			return c.client
+		}
+	}
+	return nil
+}
+
+// takeClients - unsets all clients and returns them to close, must be called under site lock
+func (r *rldpInfo) takeClients() []RLDP {
+	var list []RLDP
+	for i, c := range r.Clients {
+		if c != nil {
+			list = append(list, c.client)
+			r.Clients[i] = nil
+		}
+	}
+	return list
+}
+
+// inFlight - returns number of connections and requests in progress, must be called under site lock
+func (r *rldpInfo) inFlight() (conns, requests int) {
+	for _, c := range r.Clients {
+		if c != nil {
+			conns++
+			requests += int(atomic.LoadInt32(&c.inFlight))
+		}
+	}
+	return conns, requests
+}
+
+// acquireConn - picks the least loaded connection of the site, opens a new one when all are busy,
+// and waits for a free slot when pool is full. Connection to avoid, like the one request has just failed on,
+// is used only when there is no other one and new one cannot be opened. Returned connection must be released.
+func (s *siteInfo) acquireConn(ctx context.Context, t *Transport, host string, act *rldpInfo, avoid *rldpConn) (*rldpConn, error) {
+	for {
+		s.mx.Lock()
+		best, freeSlot := act.leastLoaded(avoid)
+
+		if best == nil {
+			s.mx.Unlock()
+			return nil, errNoConnections
+		}
+
+		if best != avoid && atomic.LoadInt32(&best.inFlight) < _RLDPMaxInFlight {
+			atomic.AddInt32(&best.inFlight, 1)
+			s.mx.Unlock()
+			return best, nil
+		}
+
+		if freeSlot >= 0 && !time.Now().Before(act.dialAfter) {
+			// reserve slot, and connect outside of lock, to not block other requests to the site
+			act.dialing[freeSlot] = true
+			addr := act.Addr
+			s.mx.Unlock()
+
+			c, err := s.dial(t, act, freeSlot, addr, host)
+			if err != nil {
+				return nil, err
+			}
+			if c != nil {
+				return c, nil
+			}
+			continue
+		}
+
+		if best == avoid && atomic.LoadInt32(&best.inFlight) < _RLDPMaxInFlight {
+			atomic.AddInt32(&best.inFlight, 1)
+			s.mx.Unlock()
+			return best, nil
+		}
+		dialErr := act.dialErr
+		s.mx.Unlock()
+
+		select {
+		case <-ctx.Done():
+			if dialErr != nil {
+				return nil, fmt.Errorf("%w, all connections are busy and new one cannot be opened: %v", ctx.Err(), dialErr)
+			}
+			return nil, ctx.Err()
+		case <-t.globalCtx.Done():
+			return nil, t.globalCtx.Err()
+		case <-act.slotFreed:
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
+// leastLoaded - returns connection with the least number of requests in progress, and free slot index,
+// or -1 when pool is full. Connection to avoid is returned only when there is no other one. Must be called under site lock.
+func (r *rldpInfo) leastLoaded(avoid *rldpConn) (best *rldpConn, freeSlot int) {
+	freeSlot = -1
+	hasAvoided := false
+	for i, c := range r.Clients {
+		if c == nil {
+			if freeSlot < 0 && !r.dialing[i] {
+				freeSlot = i
+			}
+			continue
+		}
+
+		if c == avoid {
+			hasAvoided = true
+			continue
+		}
+
+		if best == nil || atomic.LoadInt32(&c.inFlight) < atomic.LoadInt32(&best.inFlight) {
+			best = c
+		}
+	}
+
+	if best == nil && hasAvoided {
+		best = avoid
+	}
+	return best, freeSlot
+}
+
+// dial - opens connection in reserved slot, on failure error is recorded and next attempts are delayed,
+// nil connection without error is returned when request should wait for existing connections
+func (s *siteInfo) dial(t *Transport, act *rldpInfo, slot int, addr, host string) (*rldpConn, error) {
+	client, err := t.connectRLDP(slot, act.ID, addr, host)
+
+	s.mx.Lock()
+	act.dialing[slot] = false
+	if err != nil {
+		act.dialErr = err
+		act.dialFails++
+
+		backoff := _RLDPDialMinBackoff << (act.dialFails - 1)
+		if backoff > _RLDPDialMaxBackoff || backoff <= 0 {
+			backoff = _RLDPDialMaxBackoff
+		}
+		act.dialAfter = time.Now().Add(backoff)
+		s.mx.Unlock()
+		return nil, nil
+	}
+
+	if s.Actor != act {
+		// site was re-resolved meanwhile, new actor will be used on retry
+		s.mx.Unlock()
+		client.Close()
+		return nil, errNoConnections
+	}
+
+	act.dialErr, act.dialFails, act.dialAfter = nil, 0, time.Time{}
+	c := &rldpConn{client: client, inFlight: 1}
+	act.Clients[slot] = c
+	s.mx.Unlock()
+	return c, nil
+}
+
+func (r *rldpInfo) releaseConn(c *rldpConn) {
+	atomic.AddInt32(&c.inFlight, -1)
+
+	select {
+	case r.slotFreed <- struct{}{}:
+	default:
+	}
+}
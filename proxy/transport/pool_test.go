@@ -0,0 +1,138 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// testPool - builds site pool, -1 is empty slot, -2 is slot being dialed, other values are requests in flight
+func testPool(slots ...int32) *rldpInfo {
+	r := &rldpInfo{
+		Clients:   make([]*rldpConn, len(slots)),
+		dialing:   make([]bool, len(slots)),
+		slotFreed: make(chan struct{}, 1),
+	}
+	for i, v := range slots {
+		switch v {
+		case -1:
+		case -2:
+			r.dialing[i] = true
+		default:
+			r.Clients[i] = &rldpConn{inFlight: v}
+		}
+	}
+	return r
+}
+
+// slotConn - returns connection in slot, nil for -1
+func slotConn(r *rldpInfo, slot int) *rldpConn {
+	if slot < 0 {
+		return nil
+	}
+	return r.Clients[slot]
+}
+
+func TestLeastLoaded(t *testing.T) {
+	tests := []struct {
+		name  string
+		slots []int32
+		// avoid - slot of connection to avoid, -1 for none
+		avoid    int
+		wantBest int
+		wantFree int
+	}{
+		{name: "empty pool", slots: []int32{-1, -1, -1}, avoid: -1, wantBest: -1, wantFree: 0},
+		{name: "single connection", slots: []int32{2, -1, -1}, avoid: -1, wantBest: 0, wantFree: 1},
+		{name: "least loaded", slots: []int32{4, 1, 3}, avoid: -1, wantBest: 1, wantFree: -1},
+		{name: "first of equal", slots: []int32{2, 2, 2}, avoid: -1, wantBest: 0, wantFree: -1},
+		{name: "dialing slot is not free", slots: []int32{3, -2, -1}, avoid: -1, wantBest: 0, wantFree: 2},
+		{name: "all free slots are dialing", slots: []int32{-2, 5, -2}, avoid: -1, wantBest: 1, wantFree: -1},
+		{name: "avoided least loaded", slots: []int32{4, 1, 3}, avoid: 1, wantBest: 2, wantFree: -1},
+		{name: "avoided is the only one", slots: []int32{-1, 1, -1}, avoid: 1, wantBest: 1, wantFree: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := testPool(tt.slots...)
+			best, free := r.leastLoaded(slotConn(r, tt.avoid))
+
+			wantBest := (*rldpConn)(nil)
+			if tt.wantBest >= 0 {
+				wantBest = r.Clients[tt.wantBest]
+			}
+			if best != wantBest {
+				t.Fatalf("want connection in slot %d, got %+v", tt.wantBest, best)
+			}
+			if free != tt.wantFree {
+				t.Fatalf("want free slot %d, got %d", tt.wantFree, free)
+			}
+		})
+	}
+}
+
+func TestInFlight(t *testing.T) {
+	conns, requests := testPool(3, -1, 2, -2).inFlight()
+	if conns != 2 || requests != 5 {
+		t.Fatalf("want 2 connections and 5 requests, got %d and %d", conns, requests)
+	}
+}
+
+func TestAcquireConn(t *testing.T) {
+	tests := []struct {
+		name  string
+		slots []int32
+		// avoid - slot of connection to avoid, -1 for none
+		avoid    int
+		wantSlot int
+		wantErr  error
+	}{
+		{name: "no connections", slots: []int32{-1, -1}, avoid: -1, wantErr: errNoConnections},
+		{name: "least loaded", slots: []int32{3, 1}, avoid: -1, wantSlot: 1},
+		{name: "least loaded below limit", slots: []int32{_RLDPMaxInFlight, _RLDPMaxInFlight - 1}, avoid: -1, wantSlot: 1},
+		{name: "other than avoided", slots: []int32{3, 1}, avoid: 1, wantSlot: 0},
+		// pool is full, so avoided connection is better than waiting
+		{name: "only avoided", slots: []int32{1, -2}, avoid: 0, wantSlot: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			act := testPool(tt.slots...)
+			s := &siteInfo{Actor: act}
+			tr := &Transport{globalCtx: context.Background()}
+
+			c, err := s.acquireConn(context.Background(), tr, "site.ton", act, slotConn(act, tt.avoid))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("want error %v, got %v", tt.wantErr, err)
+			}
+			if err != nil {
+				return
+			}
+
+			if c != act.Clients[tt.wantSlot] {
+				t.Fatalf("want connection in slot %d", tt.wantSlot)
+			}
+			if c.inFlight != tt.slots[tt.wantSlot]+1 {
+				t.Fatalf("request is not counted, in flight %d", c.inFlight)
+			}
+
+			act.releaseConn(c)
+			if c.inFlight != tt.slots[tt.wantSlot] {
+				t.Fatalf("request is not released, in flight %d", c.inFlight)
+			}
+		})
+	}
+}
+
+func TestAcquireConnWaitsWhenFull(t *testing.T) {
+	act := testPool(_RLDPMaxInFlight, _RLDPMaxInFlight)
+	s := &siteInfo{Actor: act}
+	tr := &Transport{globalCtx: context.Background()}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := s.acquireConn(ctx, tr, "site.ton", act, nil); !errors.Is(err, context.Canceled) {
+		t.Fatalf("want cancelled wait, got %v", err)
+	}
+}
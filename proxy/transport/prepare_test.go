@@ -0,0 +1,86 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestGetActorWaitsForSharedPrepare(t *testing.T) {
+	errPrepare := errors.New("prepare failed")
+
+	tests := []struct {
+		name       string
+		prepareErr error
+		cancelReq  bool
+		stopGlobal bool
+		wantErr    error
+	}{
+		{name: "preparation failed", prepareErr: errPrepare, wantErr: errPrepare},
+		{name: "request cancelled", cancelReq: true, wantErr: context.Canceled},
+		{name: "transport stopped", stopGlobal: true, wantErr: context.Canceled},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := &Transport{}
+			var stop context.CancelFunc
+			tr.globalCtx, stop = context.WithCancel(context.Background())
+			defer stop()
+
+			call := &prepareCall{done: make(chan struct{})}
+			s := &siteInfo{preparing: call}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			switch {
+			case tt.cancelReq:
+				cancel()
+			case tt.stopGlobal:
+				stop()
+			default:
+				call.err = tt.prepareErr
+				close(call.done)
+			}
+
+			_, err := s.getActor(ctx, tr, "site.ton")
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("want error %v, got %v", tt.wantErr, err)
+			}
+
+			// request which gave up should not start another preparation
+			if s.preparing != call {
+				t.Fatal("shared preparation was replaced")
+			}
+		})
+	}
+}
+
+func TestGetActorReady(t *testing.T) {
+	bag := &bagInfo{}
+	s := &siteInfo{Actor: bag, LastSuccess: time.Now().Unix()}
+
+	actor, err := s.getActor(context.Background(), &Transport{globalCtx: context.Background()}, "site.bag")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actor != bag {
+		t.Fatalf("want ready bag, got %v", actor)
+	}
+}
+
+func TestPrepareFailsFastInBackoff(t *testing.T) {
+	s := &siteInfo{}
+	s.health.failure(errors.New("connection failed"))
+
+	start := time.Now()
+	err := s.prepare(context.Background(), &Transport{}, "site.ton")
+	if !errors.Is(err, ErrSiteBackoff) {
+		t.Fatalf("want backoff error, got %v", err)
+	}
+	if took := time.Since(start); took > _HealthMinBackoff/2 {
+		t.Fatalf("prepare waited for backoff %s", took)
+	}
+}
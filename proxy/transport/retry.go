@@ -0,0 +1,146 @@
+package transport
+
+import (
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const _RetryAttempts = 2
+const _RetryMaxWait = 3 * time.Second
+
+// each request adds this part of a retry to the budget,
+// so retries can be no more than ~20% of requests, plus initial reserve
+const _RetryBudgetPerRequest = 0.2
+const _RetryBudgetMax = 10
+
+// retryBudget - limits total number of retries, to not multiply load when a lot of sites are down
+type retryBudget struct {
+	tokens float64
+	mx     sync.Mutex
+}
+
+func newRetryBudget() *retryBudget {
+	return &retryBudget{tokens: _RetryBudgetMax}
+}
+
+func (b *retryBudget) deposit() {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	b.tokens += _RetryBudgetPerRequest
+	if b.tokens > _RetryBudgetMax {
+		b.tokens = _RetryBudgetMax
+	}
+}
+
+func (b *retryBudget) withdraw() bool {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// connError - rldp query failed, so connection may be broken, unlike errors of response parsing
+type connError struct {
+	err error
+}
+
+func (e *connError) Error() string {
+	return e.err.Error()
+}
+
+func (e *connError) Unwrap() error {
+	return e.err
+}
+
+func isRetryable(request *http.Request) bool {
+	switch request.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+	default:
+		return false
+	}
+	// body is consumed by the first attempt, so we cannot send it again
+	return request.Body == nil || request.Body == http.NoBody
+}
+
+// doRldpHttpWithRetry - executes request, and when the connection fails, retries idempotent requests
+// over another connection of the site. Failed connection may still carry other requests, so it is dropped,
+// with switch to the next known address, only when site health says it is dead. When there was no connection,
+// request was not sent, so it is retried regardless of method.
+func (t *Transport) doRldpHttpWithRetry(site *siteInfo, act *rldpInfo, host string, request *http.Request) (*http.Response, error) {
+	t.retryBudget.deposit()
+
+	var failed *rldpConn
+	for attempt := 0; ; attempt++ {
+		conn, err := site.acquireConn(request.Context(), t, host, act, failed)
+		if err != nil && !errors.Is(err, errNoConnections) {
+			return nil, err
+		}
+
+		sent := err == nil
+		if sent {
+			var resp *http.Response
+			resp, err = t.doRldpHttp(conn.client, host, request, func() {
+				act.releaseConn(conn)
+			})
+			if err == nil {
+				return resp, nil
+			}
+
+			var ce *connError
+			if request.Context().Err() != nil || !errors.As(err, &ce) {
+				// connection is fine, it was cancelled or site responded with something wrong
+				return nil, err
+			}
+			site.health.failure(err)
+			if site.health.dead() {
+				site.dropClient(conn.client, true)
+			} else {
+				// slot is already released, retry goes over other connection when there is one
+				failed = conn
+			}
+		}
+
+		if attempt >= _RetryAttempts || (sent && (!isRetryable(request) || !t.retryBudget.withdraw())) {
+			if errors.Is(err, errNoConnections) {
+				return nil, fmt.Errorf("%w, no active connections", ErrSiteBackoff)
+			}
+			return nil, err
+		}
+
+		log.Debug().Err(err).Str("host", host).Str("url", request.URL.String()).Int("attempt", attempt+1).Msg("retrying request using new connection")
+
+		wait := site.health.waitLeft()
+		if wait > _RetryMaxWait {
+			return nil, err
+		}
+
+		if wait > 0 {
+			select {
+			case <-request.Context().Done():
+				return nil, request.Context().Err()
+			case <-t.globalCtx.Done():
+				return nil, t.globalCtx.Err()
+			case <-time.After(wait):
+			}
+		}
+
+		actor, err := site.getActor(request.Context(), t, host)
+		if err != nil {
+			return nil, err
+		}
+
+		var ok bool
+		if act, ok = actor.(*rldpInfo); !ok {
+			return nil, errors.New("site is not served over rldp anymore")
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package transport
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		method string
+		body   io.ReadCloser
+		want   bool
+	}{
+		{method: http.MethodGet, want: true},
+		{method: http.MethodHead, want: true},
+		{method: http.MethodOptions, want: true},
+		{method: http.MethodGet, body: http.NoBody, want: true},
+		{method: http.MethodGet, body: io.NopCloser(strings.NewReader("data")), want: false},
+		{method: http.MethodPost, want: false},
+		{method: http.MethodPut, want: false},
+		{method: http.MethodDelete, want: false},
+		{method: http.MethodPatch, body: io.NopCloser(strings.NewReader("data")), want: false},
+	}
+
+	for _, tt := range tests {
+		name := tt.method
+		if tt.body != nil && tt.body != http.NoBody {
+			name += " with body"
+		}
+
+		t.Run(name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, "http://site.ton/", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Body = tt.body
+
+			if got := isRetryable(req); got != tt.want {
+				t.Fatalf("want %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	tests := []struct {
+		name      string
+		deposits  int
+		withdraws int
+		want      int
+	}{
+		{name: "initial reserve", withdraws: 20, want: _RetryBudgetMax},
+		{name: "deposits are capped", deposits: 100, withdraws: 20, want: _RetryBudgetMax},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newRetryBudget()
+			for i := 0; i < tt.deposits; i++ {
+				b.deposit()
+			}
+
+			got := 0
+			for i := 0; i < tt.withdraws; i++ {
+				if b.withdraw() {
+					got++
+				}
+			}
+			if got != tt.want {
+				t.Fatalf("want %d retries allowed, got %d", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestRetryBudgetRefill(t *testing.T) {
+	b := newRetryBudget()
+	for b.withdraw() {
+	}
+
+	// every request gives a part of a retry
+	perRetry := int(math.Round(1 / _RetryBudgetPerRequest))
+	for i := 0; i < perRetry-1; i++ {
+		b.deposit()
+	}
+	if b.withdraw() {
+		t.Fatalf("retry allowed after %d requests", perRetry-1)
+	}
+
+	b.deposit()
+	if !b.withdraw() {
+		t.Fatalf("retry is not allowed after %d requests", perRetry)
+	}
+}
+
+func TestConnErrorUnwrap(t *testing.T) {
+	base := errors.New("query timeout")
+	err := fmt.Errorf("failed to query site: %w", &connError{err: base})
+
+	var ce *connError
+	if !errors.As(err, &ce) {
+		t.Fatal("connection error is not detected")
+	}
+	if !errors.Is(err, base) {
+		t.Fatal("original error is lost")
+	}
+}
+
+func TestSiteHealthDead(t *testing.T) {
+	tests := []struct {
+		name     string
+		failures int
+		success  bool
+		want     bool
+	}{
+		{name: "no failures", failures: 0, want: false},
+		{name: "single failure", failures: 1, want: false},
+		{name: "below limit", failures: _HealthDeadAfter - 1, want: false},
+		{name: "limit reached", failures: _HealthDeadAfter, want: true},
+		{name: "success after failures", failures: _HealthDeadAfter, success: true, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var h siteHealth
+			for i := 0; i < tt.failures; i++ {
+				h.failure(errors.New("timeout"))
+			}
+			if tt.success {
+				h.success()
+			}
+
+			if got := h.dead(); got != tt.want {
+				t.Fatalf("want dead %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,225 @@
+package proxy
+
+import (
+	"errors"
+	"github.com/rs/zerolog/log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// addresses web2 connection sent nothing to during this time are delivered to adnl again
+const _Web2AddrTTL = 5 * time.Minute
+
+// _ReadErrorDelay - pause before next read from tunnel after failed one, to not spin on persistent error
+const _ReadErrorDelay = 100 * time.Millisecond
+
+// _Web2AddrsMax - max number of tracked web2 addresses, the oldest are forgotten when it is reached
+const _Web2AddrsMax = 4096
+
+// packetMux - splits packets of a single tunnel between adnl and web2 connections,
+// packets from addresses web2 connection recently sent something to are delivered to it, all others to adnl
+type packetMux struct {
+	conn net.PacketConn
+	adnl *muxConn
+	web2 *muxConn
+
+	web2Addrs map[string]time.Time
+	addrsMx   sync.Mutex
+}
+
+type muxPacket struct {
+	data []byte
+	addr net.Addr
+}
+
+// muxConn - virtual packet connection, fed by mux
+type muxConn struct {
+	mux     *packetMux
+	packets chan muxPacket
+	isWeb2  bool
+
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	deadline        time.Time
+	deadlineChanged chan struct{}
+	mx              sync.Mutex
+}
+
+func newPacketMux(conn net.PacketConn) *packetMux {
+	m := &packetMux{conn: conn, web2Addrs: map[string]time.Time{}}
+	m.adnl = m.newConn(false)
+	m.web2 = m.newConn(true)
+
+	go m.reader()
+	return m
+}
+
+func (m *packetMux) newConn(isWeb2 bool) *muxConn {
+	return &muxConn{
+		mux:             m,
+		packets:         make(chan muxPacket, 1024),
+		isWeb2:          isWeb2,
+		closed:          make(chan struct{}),
+		deadlineChanged: make(chan struct{}),
+	}
+}
+
+func (m *packetMux) reader() {
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := m.conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+
+			log.Debug().Err(err).Msg("failed to read packet from tunnel")
+			select {
+			case <-m.adnl.closed:
+				return
+			case <-time.After(_ReadErrorDelay):
+			}
+			continue
+		}
+
+		target := m.adnl
+		if m.isWeb2Addr(addr.String()) {
+			target = m.web2
+		}
+
+		data := make([]byte, n)
+		copy(data, buf[:n])
+
+		select {
+		case target.packets <- muxPacket{data: data, addr: addr}:
+		default:
+			// drop when reader is too slow, as network would do
+		}
+	}
+}
+
+func (m *packetMux) isWeb2Addr(addr string) bool {
+	m.addrsMx.Lock()
+	defer m.addrsMx.Unlock()
+
+	expires, ok := m.web2Addrs[addr]
+	if ok && time.Now().After(expires) {
+		delete(m.web2Addrs, addr)
+		return false
+	}
+	return ok
+}
+
+// markWeb2Addr - extends ttl of web2 address, when limit is reached, expired and then the oldest addresses are removed
+func (m *packetMux) markWeb2Addr(addr string) {
+	now := time.Now()
+
+	m.addrsMx.Lock()
+	defer m.addrsMx.Unlock()
+
+	if _, ok := m.web2Addrs[addr]; !ok && len(m.web2Addrs) >= _Web2AddrsMax {
+		oldest, oldestExpires := "", time.Time{}
+		for a, expires := range m.web2Addrs {
+			if now.After(expires) {
+				delete(m.web2Addrs, a)
+			} else if oldest == "" || expires.Before(oldestExpires) {
+				oldest, oldestExpires = a, expires
+			}
+		}
+
+		if len(m.web2Addrs) >= _Web2AddrsMax {
+			delete(m.web2Addrs, oldest)
+		}
+	}
+	m.web2Addrs[addr] = now.Add(_Web2AddrTTL)
+}
+
+func (c *muxConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		c.mx.Lock()
+		deadline := c.deadline
+		changed := c.deadlineChanged
+		c.mx.Unlock()
+
+		var timeout <-chan time.Time
+		var tm *time.Timer
+		if !deadline.IsZero() {
+			left := time.Until(deadline)
+			if left <= 0 {
+				return 0, nil, os.ErrDeadlineExceeded
+			}
+
+			tm = time.NewTimer(left)
+			timeout = tm.C
+		}
+
+		select {
+		case pk := <-c.packets:
+			if tm != nil {
+				tm.Stop()
+			}
+			return copy(p, pk.data), pk.addr, nil
+		case <-c.closed:
+			if tm != nil {
+				tm.Stop()
+			}
+			return 0, nil, net.ErrClosed
+		case <-timeout:
+			return 0, nil, os.ErrDeadlineExceeded
+		case <-changed:
+			// deadline was updated during read, wait again with the new one
+			if tm != nil {
+				tm.Stop()
+			}
+		}
+	}
+}
+
+func (c *muxConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+
+	if c.isWeb2 {
+		c.mux.markWeb2Addr(addr.String())
+	}
+	return c.mux.conn.WriteTo(p, addr)
+}
+
+// Close - closing adnl connection closes the tunnel too, web2 one is closed only by itself
+func (c *muxConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
+
+	if !c.isWeb2 {
+		return c.mux.conn.Close()
+	}
+	return nil
+}
+
+func (c *muxConn) LocalAddr() net.Addr {
+	return c.mux.conn.LocalAddr()
+}
+
+func (c *muxConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *muxConn) SetReadDeadline(t time.Time) error {
+	c.mx.Lock()
+	c.deadline = t
+	close(c.deadlineChanged)
+	c.deadlineChanged = make(chan struct{})
+	c.mx.Unlock()
+	return nil
+}
+
+func (c *muxConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
@@ -0,0 +1,227 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/net/dns/dnsmessage"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DefaultTunnelWeb2DoH - DNS over HTTPS server used to resolve web2 domains through the tunnel, when not set in Options
+const DefaultTunnelWeb2DoH = "https://1.1.1.1/dns-query"
+
+// newTunnelHTTPClient - returns http client which sends requests over HTTP/3 through packet connection of tunnel,
+// and closer of its quic connections, conn itself is not closed by it
+func newTunnelHTTPClient(conn net.PacketConn, doh string) (*http.Client, func()) {
+	if doh == "" {
+		doh = DefaultTunnelWeb2DoH
+	}
+
+	qt := &quic.Transport{Conn: conn}
+	res := &dohResolver{server: doh, cache: map[string]dohRecord{}}
+
+	h3 := &http3.Transport{
+		TLSClientConfig: &tls.Config{},
+		QUICConfig: &quic.Config{
+			HandshakeIdleTimeout: 7 * time.Second,
+			KeepAlivePeriod:      10 * time.Second,
+		},
+		Dial: func(ctx context.Context, addr string, tlsCfg *tls.Config, cfg *quic.Config) (*quic.Conn, error) {
+			host, portStr, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, err
+			}
+
+			port, err := strconv.Atoi(portStr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid port: %w", err)
+			}
+
+			ip := net.ParseIP(host)
+			if ip == nil {
+				if ip, err = res.resolve(ctx, host); err != nil {
+					return nil, fmt.Errorf("failed to resolve %s through tunnel: %w", host, err)
+				}
+			}
+
+			c, err := qt.DialEarly(ctx, &net.UDPAddr{IP: ip, Port: port}, tlsCfg, cfg)
+			if err != nil {
+				return nil, fmt.Errorf("failed to connect to %s over HTTP/3 through tunnel, site may not support it: %w", host, err)
+			}
+			return c, nil
+		},
+	}
+	res.client = &http.Client{Transport: h3, Timeout: 10 * time.Second}
+
+	closer := func() {
+		_ = h3.Close()
+		// interrupts read of quic reader from conn
+		_ = qt.Close()
+	}
+	return &http.Client{Transport: &tunnelRoundTripper{rt: h3}}, closer
+}
+
+// ErrTunnelPlainHTTP - site is requested over plain http, which cannot be sent through tunnel
+var ErrTunnelPlainHTTP = errors.New("plain http sites are not available when web2 is sent through tunnel, use https")
+
+// tunnelRoundTripper - rejects plain http requests, because HTTP/3 works only over tls
+type tunnelRoundTripper struct {
+	rt http.RoundTripper
+}
+
+func (t *tunnelRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme != "https" {
+		if req.Body != nil {
+			_ = req.Body.Close()
+		}
+		return nil, ErrTunnelPlainHTTP
+	}
+	return t.rt.RoundTrip(req)
+}
+
+// resolved domains are cached for their dns ttl, but within these bounds
+const _DoHMinTTL = 30 * time.Second
+const _DoHMaxTTL = 1 * time.Hour
+
+// _DoHCacheMax - max number of cached domains, expired and then the soonest expiring are removed when it is reached
+const _DoHCacheMax = 4096
+
+type dohRecord struct {
+	ip      net.IP
+	expires time.Time
+}
+
+// dohResolver - resolves domains using DNS over HTTPS, to not leak dns queries outside the tunnel
+type dohResolver struct {
+	server string
+	client *http.Client
+
+	cache map[string]dohRecord
+	mx    sync.Mutex
+}
+
+// resolve - returns ipv4 address of domain, or ipv6 when it has no ipv4
+func (r *dohResolver) resolve(ctx context.Context, host string) (net.IP, error) {
+	r.mx.Lock()
+	rec, ok := r.cache[host]
+	r.mx.Unlock()
+	if ok && time.Now().Before(rec.expires) {
+		return rec.ip, nil
+	}
+
+	ip, ttl, err := r.query(ctx, host, dnsmessage.TypeA)
+	if err != nil {
+		return nil, err
+	}
+	if ip == nil {
+		if ip, ttl, err = r.query(ctx, host, dnsmessage.TypeAAAA); err != nil {
+			return nil, err
+		}
+		if ip == nil {
+			return nil, fmt.Errorf("no A or AAAA records found")
+		}
+	}
+
+	if ttl < _DoHMinTTL {
+		ttl = _DoHMinTTL
+	} else if ttl > _DoHMaxTTL {
+		ttl = _DoHMaxTTL
+	}
+	r.store(host, dohRecord{ip: ip, expires: time.Now().Add(ttl)})
+
+	return ip, nil
+}
+
+func (r *dohResolver) store(host string, rec dohRecord) {
+	now := time.Now()
+
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	if _, ok := r.cache[host]; !ok && len(r.cache) >= _DoHCacheMax {
+		soonest, soonestExpires := "", time.Time{}
+		for h, c := range r.cache {
+			if now.After(c.expires) {
+				delete(r.cache, h)
+			} else if soonest == "" || c.expires.Before(soonestExpires) {
+				soonest, soonestExpires = h, c.expires
+			}
+		}
+
+		if len(r.cache) >= _DoHCacheMax {
+			delete(r.cache, soonest)
+		}
+	}
+	r.cache[host] = rec
+}
+
+// query - asks dns over https server for record of type A or AAAA, nil ip is returned when there are no such records
+func (r *dohResolver) query(ctx context.Context, host string, typ dnsmessage.Type) (net.IP, time.Duration, error) {
+	name, err := dnsmessage.NewName(host + ".")
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid domain: %w", err)
+	}
+
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: uint16(rand.Uint32()), RecursionDesired: true},
+		Questions: []dnsmessage.Question{
+			{Name: name, Type: typ, Class: dnsmessage.ClassINET},
+		},
+	}
+	query, err := msg.Pack()
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to pack dns query: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.server, bytes.NewReader(query))
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, 0, fmt.Errorf("dns over https request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("dns over https server returned status %d", resp.StatusCode)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 65536))
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read dns response: %w", err)
+	}
+
+	if err = msg.Unpack(data); err != nil {
+		return nil, 0, fmt.Errorf("failed to parse dns response: %w", err)
+	}
+
+	for _, a := range msg.Answers {
+		ttl := time.Duration(a.Header.TTL) * time.Second
+		switch res := a.Body.(type) {
+		case *dnsmessage.AResource:
+			if typ == dnsmessage.TypeA {
+				return net.IP(res.A[:]), ttl, nil
+			}
+		case *dnsmessage.AAAAResource:
+			if typ == dnsmessage.TypeAAAA {
+				return net.IP(res.AAAA[:]), ttl, nil
+			}
+		}
+	}
+	return nil, 0, nil
+}